@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultArrowBatchSize = 10000
+	maxArrowBatchSize     = 1000000
+)
+
+// parseBatchSize parses the number of rows per record batch of the arrow
+// formats, 0 when the format default applies.
+func parseBatchSize(params url.Values) (int, error) {
+	value := params.Get("batchsize")
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxArrowBatchSize {
+		return 0, fmt.Errorf("invalid batchsize value: %s. Allowed is 1 up to %d", value, maxArrowBatchSize)
+	}
+	return n, nil
+}
+
+// arrowType maps a database type name onto an arrow type. Types without an
+// arrow counterpart, such as cidr, uuid or numeric, are kept as their text.
+func arrowType(dbType string) arrow.DataType {
+	dbType = strings.ToUpper(dbType)
+	if strings.HasPrefix(dbType, "_") {
+		switch element := arrowType(dbType[1:]); element.ID() {
+		case arrow.BOOL, arrow.INT16, arrow.INT32, arrow.INT64, arrow.FLOAT32, arrow.FLOAT64:
+			return arrow.ListOf(element)
+		}
+		return arrow.ListOf(arrow.BinaryTypes.String)
+	}
+
+	switch dbType {
+	case "BOOL":
+		return arrow.FixedWidthTypes.Boolean
+	case "INT2":
+		return arrow.PrimitiveTypes.Int16
+	case "INT4":
+		return arrow.PrimitiveTypes.Int32
+	case "INT8", "OID":
+		// oid is unsigned 32 bit, lib/pq scans it as text
+		return arrow.PrimitiveTypes.Int64
+	case "FLOAT4":
+		return arrow.PrimitiveTypes.Float32
+	case "FLOAT8":
+		return arrow.PrimitiveTypes.Float64
+	case "DATE":
+		return arrow.FixedWidthTypes.Date32
+	case "TIME":
+		return arrow.FixedWidthTypes.Time64us
+	case "TIMESTAMP":
+		return &arrow.TimestampType{Unit: arrow.Microsecond}
+	case "TIMESTAMPTZ":
+		return arrow.FixedWidthTypes.Timestamp_us
+	case "BYTEA":
+		return arrow.BinaryTypes.Binary
+	}
+	return arrow.BinaryTypes.String
+}
+
+// arrowSchema builds the schema of the result. The database type of every
+// column is kept in the pg_type field metadata.
+func arrowSchema(columnTypes []*sql.ColumnType) *arrow.Schema {
+	fields := make([]arrow.Field, len(columnTypes))
+	for i, ct := range columnTypes {
+		fields[i] = arrow.Field{
+			Name:     ct.Name(),
+			Type:     arrowType(ct.DatabaseTypeName()),
+			Nullable: true,
+			Metadata: arrow.NewMetadata([]string{"pg_type"}, []string{strings.ToLower(ct.DatabaseTypeName())}),
+		}
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// appendArrowValue appends a value as scanned from lib/pq to the builder of its column
+func appendArrowValue(builder array.Builder, v interface{}) error {
+	if v == nil {
+		builder.AppendNull()
+		return nil
+	}
+
+	switch b := builder.(type) {
+	case *array.BooleanBuilder:
+		if value, ok := v.(bool); ok {
+			b.Append(value)
+			return nil
+		}
+	case *array.Int16Builder:
+		if value, ok := v.(int64); ok {
+			b.Append(int16(value))
+			return nil
+		}
+	case *array.Int32Builder:
+		if value, ok := v.(int64); ok {
+			b.Append(int32(value))
+			return nil
+		}
+	case *array.Int64Builder:
+		switch value := v.(type) {
+		case int64:
+			b.Append(value)
+			return nil
+		case []byte:
+			n, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return err
+			}
+			b.Append(n)
+			return nil
+		}
+	case *array.Float32Builder:
+		if value, ok := v.(float64); ok {
+			b.Append(float32(value))
+			return nil
+		}
+	case *array.Float64Builder:
+		if value, ok := v.(float64); ok {
+			b.Append(value)
+			return nil
+		}
+	case *array.Date32Builder:
+		if value, ok := v.(time.Time); ok {
+			b.Append(arrow.Date32FromTime(value))
+			return nil
+		}
+	case *array.Time64Builder:
+		if value, ok := v.(time.Time); ok {
+			midnight := time.Date(value.Year(), value.Month(), value.Day(), 0, 0, 0, 0, value.Location())
+			b.Append(arrow.Time64(value.Sub(midnight).Microseconds()))
+			return nil
+		}
+	case *array.TimestampBuilder:
+		if value, ok := v.(time.Time); ok {
+			b.Append(arrow.Timestamp(value.UnixMicro()))
+			return nil
+		}
+	case *array.BinaryBuilder:
+		if value, ok := v.([]byte); ok {
+			b.Append(value)
+			return nil
+		}
+	case *array.StringBuilder:
+		switch value := v.(type) {
+		case []byte:
+			b.Append(string(value))
+		case string:
+			b.Append(value)
+		case time.Time:
+			b.Append(value.Format(time.RFC3339Nano))
+		default:
+			b.Append(fmt.Sprintf("%v", value))
+		}
+		return nil
+	case *array.ListBuilder:
+		if value, ok := v.([]byte); ok {
+			return appendArrowList(b, value)
+		}
+	}
+	return fmt.Errorf("can't convert %T to arrow %s", v, builder.Type())
+}
+
+// appendArrowList parses a one dimensional Postgres array and appends it as list
+func appendArrowList(b *array.ListBuilder, value []byte) error {
+	elements := []sql.NullString{}
+	if err := (pq.GenericArray{A: &elements}).Scan(value); err != nil {
+		return err
+	}
+
+	b.Append(true)
+	for _, element := range elements {
+		if !element.Valid {
+			b.ValueBuilder().AppendNull()
+			continue
+		}
+
+		var err error
+		switch vb := b.ValueBuilder().(type) {
+		case *array.BooleanBuilder:
+			vb.Append(element.String == "t" || element.String == "true")
+		case *array.Int16Builder:
+			var n int64
+			n, err = strconv.ParseInt(element.String, 10, 16)
+			vb.Append(int16(n))
+		case *array.Int32Builder:
+			var n int64
+			n, err = strconv.ParseInt(element.String, 10, 32)
+			vb.Append(int32(n))
+		case *array.Int64Builder:
+			var n int64
+			n, err = strconv.ParseInt(element.String, 10, 64)
+			vb.Append(n)
+		case *array.Float32Builder:
+			var f float64
+			f, err = strconv.ParseFloat(element.String, 32)
+			vb.Append(float32(f))
+		case *array.Float64Builder:
+			var f float64
+			f, err = strconv.ParseFloat(element.String, 64)
+			vb.Append(f)
+		case *array.StringBuilder:
+			vb.Append(element.String)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArrowBatches converts the scanned rows into records of batchSize rows
+// and passes them to write, which must not keep them after returning.
+func writeArrowBatches(s *rowScanner, schema *arrow.Schema, batchSize int, write func(arrow.Record) error) error {
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	flush := func() error {
+		record := builder.NewRecord()
+		defer record.Release()
+		return write(record)
+	}
+
+	pending := 0
+	for s.Next() {
+		for n, i := range s.Visible {
+			if err := appendArrowValue(builder.Field(n), s.Values[i]); err != nil {
+				return fmt.Errorf("column %s: %v", schema.Field(n).Name, err)
+			}
+		}
+
+		pending++
+		if pending == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// streamArrow writes the rows as Arrow IPC stream, in record batches of requestData.BatchSize rows
+func streamArrow(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	schema := arrowSchema(s.VisibleTypes())
+
+	batchSize := requestData.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultArrowBatchSize
+	}
+
+	w.Header().Set("Content-Disposition", attachment(requestData, "arrows"))
+	w.WriteHeader(http.StatusOK)
+
+	writer := ipc.NewWriter(w, ipc.WithSchema(schema))
+	if err := writeArrowBatches(s, schema, batchSize, writer.Write); err != nil {
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+)
+
+func TestArrowType(t *testing.T) {
+	testCases := []struct {
+		DBType   string
+		Expected arrow.DataType
+	}{
+		{DBType: "INT4", Expected: arrow.PrimitiveTypes.Int32},
+		{DBType: "FLOAT8", Expected: arrow.PrimitiveTypes.Float64},
+		{DBType: "TIMESTAMPTZ", Expected: arrow.FixedWidthTypes.Timestamp_us},
+		{DBType: "CIDR", Expected: arrow.BinaryTypes.String},
+		{DBType: "UUID", Expected: arrow.BinaryTypes.String},
+		{DBType: "OID", Expected: arrow.PrimitiveTypes.Int64},
+		{DBType: "_OID", Expected: arrow.ListOf(arrow.PrimitiveTypes.Int64)},
+		{DBType: "_INT8", Expected: arrow.ListOf(arrow.PrimitiveTypes.Int64)},
+		{DBType: "_TEXT", Expected: arrow.ListOf(arrow.BinaryTypes.String)},
+		{DBType: "_INET", Expected: arrow.ListOf(arrow.BinaryTypes.String)},
+	}
+
+	for i, tc := range testCases {
+		if dataType := arrowType(tc.DBType); !arrow.TypeEqual(dataType, tc.Expected) {
+			t.Errorf("test number %d: expected %s for %s, got %s", i+1, tc.Expected, tc.DBType, dataType)
+		}
+	}
+}
+
+func TestParseBatchSize(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected int
+		Err      bool
+	}{
+		{Input: "", Expected: 0},
+		{Input: "batchsize=500", Expected: 500},
+		{Input: "batchsize=0", Err: true},
+		{Input: "batchsize=many", Err: true},
+		{Input: "batchsize=1000001", Err: true},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.Input)
+		n, err := parseBatchSize(params)
+		if (err != nil) != tc.Err || n != tc.Expected {
+			t.Errorf("test number %d: expected %d (error %v), got %d %v", i+1, tc.Expected, tc.Err, n, err)
+		}
+	}
+}
+
+func TestStreamArrow(t *testing.T) {
+	seen := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	result := fakeResult{
+		Columns: []string{"id", "ip_address", "seen", "ports", "tags", "owner", "owners"},
+		Types:   []string{"INT8", "INET", "TIMESTAMPTZ", "_INT4", "_TEXT", "OID", "_OID"},
+		Rows: [][]driver.Value{
+			{int64(1), []byte("10.0.0.1/32"), seen, []byte("{22,443}"), []byte(`{a,"b c",NULL}`), []byte("4294967295"), []byte("{10,4294967295}")},
+			{int64(2), nil, nil, nil, []byte("{}"), nil, nil},
+			{int64(3), []byte("10.0.0.3/32"), seen, []byte("{NULL}"), nil, []byte("16384"), nil},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	encodeResponse(w, queryFake(t, result), &RequestData{Format: "arrow", BatchSize: 2, Name: "domain.arp"})
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=domain.arp.arrows" {
+		t.Errorf("unexpected disposition %s", disposition)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/vnd.apache.arrow.stream" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+
+	reader, err := ipc.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+
+	schema := reader.Schema()
+	if pgType, _ := schema.Field(1).Metadata.GetValue("pg_type"); pgType != "inet" {
+		t.Errorf("expected pg_type inet, got %s", pgType)
+	}
+
+	batches := []int64{}
+	var first arrow.Record
+	for reader.Next() {
+		record := reader.Record()
+		if first == nil {
+			record.Retain()
+			first = record
+		}
+		batches = append(batches, record.NumRows())
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Fatalf("expected batches of 2 and 1 rows, got %v", batches)
+	}
+	defer first.Release()
+
+	if id := first.Column(0).(*array.Int64).Value(1); id != 2 {
+		t.Errorf("expected id 2, got %d", id)
+	}
+	if !first.Column(1).IsNull(1) || first.Column(1).(*array.String).Value(0) != "10.0.0.1/32" {
+		t.Errorf("unexpected ip_address column %v", first.Column(1))
+	}
+	if ts := first.Column(2).(*array.Timestamp).Value(0); ts != arrow.Timestamp(seen.UnixMicro()) {
+		t.Errorf("unexpected timestamp %v", ts)
+	}
+
+	ports := first.Column(3).(*array.List)
+	start, end := ports.ValueOffsets(0)
+	values := ports.ListValues().(*array.Int32)
+	if end-start != 2 || values.Value(int(start)) != 22 || values.Value(int(start)+1) != 443 {
+		t.Errorf("unexpected ports %v", ports)
+	}
+
+	tags := first.Column(4).(*array.List)
+	start, end = tags.ValueOffsets(0)
+	tagValues := tags.ListValues().(*array.String)
+	if end-start != 3 || tagValues.Value(int(start)+1) != "b c" || !tagValues.IsNull(int(start)+2) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	if owner := first.Column(5).(*array.Int64); owner.Value(0) != 4294967295 || !owner.IsNull(1) {
+		t.Errorf("unexpected owner column %v", owner)
+	}
+	owners := first.Column(6).(*array.List)
+	start, end = owners.ValueOffsets(0)
+	ownerValues := owners.ListValues().(*array.Int64)
+	if end-start != 2 || ownerValues.Value(int(start)+1) != 4294967295 {
+		t.Errorf("unexpected owners %v", owners)
+	}
+}
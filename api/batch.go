@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	maxBatchQueries  = 20
+	batchConcurrency = 4
+)
+
+// Batch is a list of static or generated queries answered from one snapshot
+type Batch struct {
+	Queries []BatchQuery `json:"queries"`
+}
+
+// BatchQuery is a static query (api, params and the filter query string in
+// query) or a generated query (gen with an /api/gen query string).
+type BatchQuery struct {
+	ID     string   `json:"id"`
+	API    string   `json:"api"`
+	Params []string `json:"params"`
+	Query  string   `json:"query"`
+	Gen    string   `json:"gen"`
+}
+
+type BatchResult struct {
+	Rows  *ResultSet `json:"rows,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+func parseBatch(batch *Batch) error {
+	if len(batch.Queries) == 0 {
+		return fmt.Errorf("batch expects at least one query")
+	}
+	if len(batch.Queries) > maxBatchQueries {
+		return fmt.Errorf("batch allows at most %d queries, got %d", maxBatchQueries, len(batch.Queries))
+	}
+
+	ids := map[string]bool{}
+	for _, bq := range batch.Queries {
+		if bq.ID == "" {
+			return fmt.Errorf("every batch query needs an id")
+		}
+		if ids[bq.ID] {
+			return fmt.Errorf("duplicate batch query id: %s", bq.ID)
+		}
+		if (bq.API == "") == (bq.Gen == "") {
+			return fmt.Errorf("batch query %s needs either api or gen", bq.ID)
+		}
+		ids[bq.ID] = true
+	}
+	return nil
+}
+
+// constructBatchQuery builds the SQL of a batch query the same way as
+// QueryHandler and QueryGenHandler do.
+func constructBatchQuery(db Queryer, bq BatchQuery) (string, []interface{}, error) {
+	if bq.Gen != "" {
+		params, err := url.ParseQuery(bq.Gen)
+		if err != nil {
+			return "", nil, err
+		}
+		if params.Get("pivot") != "" {
+			return "", nil, fmt.Errorf("pivot is only supported on /api/gen")
+		}
+		qp, err := ParseQueryParams(params)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(qp.Lists) > 0 {
+			return "", nil, fmt.Errorf("value lists are only supported on /api/gen")
+		}
+
+		var catalog []CatalogField
+		if len(params["field"]) == 0 {
+			if catalog, err = loadCatalog(db); err != nil {
+				return "", nil, err
+			}
+		}
+		return ConstructQuery(params, catalog)
+	}
+
+	query, exists := Queries[bq.API]
+	if !exists {
+		return "", nil, fmt.Errorf("Invalid API endpoint")
+	}
+
+	query, params, err := cleanInput(&RequestData{Query: query, Params: bq.Params})
+	if err != nil {
+		return "", nil, err
+	}
+
+	urlQueryParams, err := url.ParseQuery(bq.Query)
+	if err != nil {
+		return "", nil, err
+	}
+	if urlQueryParams.Get("pivot") != "" {
+		return "", nil, fmt.Errorf("pivot is only supported on /api/gen")
+	}
+	if !wantsSubQuery(urlQueryParams) {
+		return query, params, nil
+	}
+
+	columns, err := subQueryColumns(db, query, params)
+	if err != nil {
+		return "", nil, err
+	}
+	return ConstructSubQuery(query, params, columns, urlQueryParams)
+}
+
+// runBatchQuery runs one query in its own transaction on the exported snapshot
+func runBatchQuery(ctx context.Context, snapshot string, bq BatchQuery) (*ResultSet, error) {
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshot)); err != nil {
+		return nil, err
+	}
+
+	query, params, err := constructBatchQuery(tx, bq)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return collectRows(rows)
+}
+
+// BatchHandler runs the posted queries concurrently. The snapshot of a
+// coordinating transaction is exported and imported by every query, so all
+// results are consistent with each other. Errors are reported per query.
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "batch expects a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	batch := &Batch{}
+	if err := json.NewDecoder(r.Body).Decode(batch); err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), 400)
+		return
+	}
+	if err := parseBatch(batch); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	numericString, err := parseNumericString(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ctx := r.Context()
+	coordinator, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer coordinator.Rollback()
+
+	// The snapshot can be imported as long as the coordinator is open
+	var snapshot string
+	if err := coordinator.QueryRow("SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	results := make(map[string]*BatchResult, len(batch.Queries))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, batchConcurrency)
+
+	for _, bq := range batch.Queries {
+		wg.Add(1)
+		go func(bq BatchQuery) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result := &BatchResult{}
+			rows, err := runBatchQuery(ctx, snapshot, bq)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				rows.NumericString = numericString
+				result.Rows = rows
+			}
+
+			mutex.Lock()
+			results[bq.ID] = result
+			mutex.Unlock()
+		}(bq)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
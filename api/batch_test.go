@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Err   bool
+	}{
+		{Input: `{"queries": [{"id": "nodes", "api": "list-nodes"}, {"id": "arp", "gen": "dn=domain.arp&limit=10"}]}`, Err: false},
+		{Input: `{"queries": []}`, Err: true},
+		{Input: `{"queries": [{"api": "list-nodes"}]}`, Err: true},
+		{Input: `{"queries": [{"id": "a", "api": "list-nodes"}, {"id": "a", "api": "list-nodes"}]}`, Err: true},
+		{Input: `{"queries": [{"id": "a"}]}`, Err: true},
+		{Input: `{"queries": [{"id": "a", "api": "list-nodes", "gen": "dn=domain.arp"}]}`, Err: true},
+	}
+
+	for i, tc := range testCases {
+		batch := &Batch{}
+		if err := json.Unmarshal([]byte(tc.Input), batch); err != nil {
+			t.Fatal(err)
+		}
+		err := parseBatch(batch)
+		if (err != nil) != tc.Err {
+			t.Errorf("test number %d: expected error %v, got %v", i+1, tc.Err, err)
+		}
+	}
+
+	batch := &Batch{}
+	for i := 0; i <= maxBatchQueries; i++ {
+		batch.Queries = append(batch.Queries, BatchQuery{ID: strings.Repeat("q", i+1), API: "list-nodes"})
+	}
+	if err := parseBatch(batch); err == nil {
+		t.Errorf("expected an error for more than %d queries", maxBatchQueries)
+	}
+}
+
+func TestConstructBatchQuery(t *testing.T) {
+	query, values, err := constructBatchQuery(nil, BatchQuery{ID: "arp", Gen: "dn=domain.arp&field=domain.arp.ip_address&filter=match:domain.arp.device:eth0&limit=10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "WHERE domain_arp.device = $1") || len(values) != 1 || values[0] != "eth0" {
+		t.Errorf("unexpected gen query %s %v", query, values)
+	}
+
+	query, values, err = constructBatchQuery(nil, BatchQuery{ID: "nodes", API: "list-nodes"})
+	if err != nil || query != Queries["list-nodes"] || len(values) != 0 {
+		t.Errorf("expected the static query unchanged, got %s %v %v", query, values, err)
+	}
+
+	if _, _, err := constructBatchQuery(nil, BatchQuery{ID: "x", API: "no-such-query"}); err == nil {
+		t.Errorf("expected an error for an unknown api")
+	}
+	if _, _, err := constructBatchQuery(nil, BatchQuery{ID: "x", API: "list-nodes", Params: []string{"a"}}); err == nil {
+		t.Errorf("expected an error for a parameter count mismatch")
+	}
+
+	for _, bq := range []BatchQuery{
+		{ID: "x", Gen: "dn=domain.arp&field=domain.arp.device&filter=in_list:domain.arp.ip_address:ips"},
+		{ID: "x", Gen: "dn=domain.arp&field=domain.arp.device&filter=notin_list:domain.arp.ip_address:ips"},
+		{ID: "x", Gen: "dn=domain.arp&field=domain.arp.device&pivot=count:domain.arp.device:domain.arp.state:up,down"},
+		{ID: "x", API: "list-nodes", Query: "pivot=count:device:state:up,down"},
+	} {
+		if _, _, err := constructBatchQuery(nil, bq); err == nil || !strings.Contains(err.Error(), "only supported on /api/gen") {
+			t.Errorf("expected %s to be refused, got %v", bq.Gen+bq.Query, err)
+		}
+	}
+}
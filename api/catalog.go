@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// CatalogField is a field of a node as listed by the list-nodes query
+type CatalogField struct {
+	Node      string
+	Field     string
+	FieldType string
+	RowCount  int
+}
+
+// loadCatalog returns every node field, internal __meta__ fields are excluded
+func loadCatalog(db Queryer) ([]CatalogField, error) {
+	rows, err := db.Query(Queries["list-nodes"])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	catalog := []CatalogField{}
+	for rows.Next() {
+		var cf CatalogField
+		if err := rows.Scan(&cf.Node, &cf.Field, &cf.FieldType, &cf.RowCount); err != nil {
+			return nil, err
+		}
+		catalog = append(catalog, cf)
+	}
+	return catalog, rows.Err()
+}
+
+// Column holding the groups that are allowed to read a row
+const META_RBAC_KEY = "__meta__rbac_read_groups"
+
+// loadNodeReadGroups returns every node, true when its rows are restricted by read groups
+func loadNodeReadGroups() (map[string]bool, error) {
+	rows, err := DB.Query(`SELECT c.table_name, bool_or(c.column_name = $1)
+                           FROM information_schema.columns AS c
+                           WHERE c.table_schema = 'public'
+                           GROUP BY c.table_name`, META_RBAC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := map[string]bool{}
+	for rows.Next() {
+		var node string
+		var restricted bool
+		if err := rows.Scan(&node, &restricted); err != nil {
+			return nil, err
+		}
+		nodes[node] = restricted
+	}
+	return nodes, rows.Err()
+}
+
+// loadFieldType returns the SQL type of a node field, as used in a cast
+func loadFieldType(db Queryer, node, field string) (string, error) {
+	rows, err := db.Query(`SELECT format_type(a.atttypid, a.atttypmod)
+                           FROM pg_attribute AS a
+                           WHERE a.attrelid = to_regclass($1) AND a.attname = $2 AND a.attnum > 0 AND NOT a.attisdropped`,
+		"public."+pq.QuoteIdentifier(node), field)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("unknown field: %s.%s", node, field)
+	}
+	var fieldType string
+	if err := rows.Scan(&fieldType); err != nil {
+		return "", err
+	}
+	return fieldType, nil
+}
+
+// loadUniqueFields returns the node fields with a unique index on that field alone, as node.field
+func loadUniqueFields(db Queryer) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT c.relname, a.attname
+                           FROM pg_index AS i
+                           JOIN pg_class AS c ON c.oid = i.indrelid
+                           JOIN pg_namespace AS n ON n.oid = c.relnamespace
+                           JOIN pg_attribute AS a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+                           WHERE n.nspname = 'public' AND i.indisunique AND i.indnkeyatts = 1 AND i.indpred IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uniques := map[string]bool{}
+	for rows.Next() {
+		var node, field string
+		if err := rows.Scan(&node, &field); err != nil {
+			return nil, err
+		}
+		uniques[node+"."+field] = true
+	}
+	return uniques, rows.Err()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// columnarField describes a column in the schema of the columnar format
+type columnarField struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Node  string `json:"node,omitempty"`
+	Field string `json:"field,omitempty"`
+}
+
+// columnarMeta is written after the rows of the columnar format
+type columnarMeta struct {
+	Count     int   `json:"count"`
+	ElapsedMS int64 `json:"elapsed_ms"`
+	Truncated bool  `json:"truncated"`
+	// Error that ended the rows, they are incomplete
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// columnarType returns the Postgres type name of a column, arrays as <element>[]
+func columnarType(ct *sql.ColumnType) string {
+	dbType := strings.ToLower(ct.DatabaseTypeName())
+	if strings.HasPrefix(dbType, "_") {
+		return dbType[1:] + "[]"
+	}
+	return dbType
+}
+
+// columnarSchema returns the schema of the visible columns, with the node
+// and field they are selected from when the query was generated
+func columnarSchema(s *rowScanner, sources map[string]ColumnSource) []columnarField {
+	schema := make([]columnarField, len(s.Visible))
+	for n, i := range s.Visible {
+		schema[n] = columnarField{Name: s.Columns[i], Type: columnarType(s.Types[i])}
+		if source, ok := sources[s.Columns[i]]; ok {
+			schema[n].Node = source.Node
+			schema[n].Field = source.Field
+		}
+	}
+	return schema
+}
+
+// streamColumnar writes the column schema once and every row as an array of
+// its values in schema order, followed by metadata about the result:
+//
+//	{"schema":[{"name":..,"type":..,"node":..,"field":..}],"rows":[[..],..],"meta":{..}}
+//
+// The rows are flushed regularly to reach the client while the query still
+// runs. A failing query sets error in the metadata.
+func streamColumnar(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	decoders := s.JSONDecoders(requestData)
+	schemaJSON, err := json.Marshal(columnarSchema(s, requestData.Sources))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+
+	out := newStreamWriter(w)
+	defer out.Flush()
+	w.WriteHeader(http.StatusOK)
+
+	out.WriteString(`{"schema":`)
+	out.Write(schemaJSON)
+	out.WriteString(`,"rows":[`)
+
+	count := 0
+	for s.Next() {
+		if count > 0 {
+			out.WriteString(",")
+		}
+		if _, err := out.Write(s.JSONArray(decoders)); err != nil {
+			return err
+		}
+		count++
+		if err := out.Row(); err != nil {
+			return err
+		}
+	}
+
+	meta := columnarMeta{Count: count}
+	if !requestData.Start.IsZero() {
+		meta.ElapsedMS = time.Since(requestData.Start).Milliseconds()
+	}
+	meta.Truncated = requestData.truncated(count)
+	err = s.Err()
+	if err != nil {
+		meta.Error = streamErrorJSON(err)
+		err = reportedError{err}
+	}
+	metaJSON, _ := json.Marshal(meta)
+	out.WriteString(`],"meta":`)
+	out.Write(metaJSON)
+	out.WriteString("}")
+	return err
+}
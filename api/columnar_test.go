@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamColumnar(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "ip_address", "tags", groupRowColumn},
+		Types:   []string{"TEXT", "INET", "_TEXT", "INT8"},
+		Rows: [][]driver.Value{
+			{[]byte("eth0"), []byte("10.0.0.1/32"), []byte("{a,b}"), int64(1)},
+			{"eth1", nil, nil, int64(2)},
+		},
+	}
+	sources := map[string]ColumnSource{
+		"device":     {Node: "domain.arp", Field: "device"},
+		"ip_address": {Node: "domain.arp", Field: "ip_address"},
+	}
+
+	testCases := []struct {
+		limit     string
+		truncated bool
+	}{
+		{"", false},
+		{"2", true},
+		{"10", false},
+	}
+
+	for i, tc := range testCases {
+		w := httptest.NewRecorder()
+		requestData := &RequestData{Format: "columnar", Limit: tc.limit, Sources: sources, Start: time.Now()}
+		encodeResponse(w, queryFake(t, result), requestData)
+
+		var got struct {
+			Schema []columnarField
+			Rows   [][]interface{}
+			Meta   columnarMeta
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("test number %d: invalid JSON %q: %v", i+1, w.Body.String(), err)
+		}
+
+		schema := []columnarField{
+			{Name: "device", Type: "text", Node: "domain.arp", Field: "device"},
+			{Name: "ip_address", Type: "inet", Node: "domain.arp", Field: "ip_address"},
+			{Name: "tags", Type: "text[]"},
+		}
+		if !reflect.DeepEqual(got.Schema, schema) {
+			t.Errorf("test number %d: expected schema %v, got %v", i+1, schema, got.Schema)
+		}
+		rows := [][]interface{}{
+			{"eth0", "10.0.0.1/32", []interface{}{"a", "b"}},
+			{"eth1", nil, nil},
+		}
+		if !reflect.DeepEqual(got.Rows, rows) {
+			t.Errorf("test number %d: expected rows %v, got %v", i+1, rows, got.Rows)
+		}
+		if got.Meta.Count != 2 || got.Meta.Truncated != tc.truncated {
+			t.Errorf("test number %d: unexpected meta %+v", i+1, got.Meta)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	encodeResponse(w, queryFake(t, fakeResult{Columns: []string{"device"}}), &RequestData{Format: "columnar"})
+	expected := `{"schema":[{"name":"device","type":"text"}],"rows":[],"meta":{"count":0,"elapsed_ms":0,"truncated":false}}`
+	if w.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, w.Body.String())
+	}
+}
+
+func TestColumnSources(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected map[string]ColumnSource
+	}{
+		{
+			"dn=domain.arp&field=domain.arp.device&field=domain.arp.ip_address%20as%20ip",
+			map[string]ColumnSource{
+				"device": {Node: "domain.arp", Field: "device"},
+				"ip":     {Node: "domain.arp", Field: "ip_address"},
+			},
+		},
+		{
+			"dn=domain.arp&field=domain.arp.device&field=domain.interfaces.mtu&link=domain.arp.device:domain.interfaces.name",
+			map[string]ColumnSource{
+				"domain.arp.device":     {Node: "domain.arp", Field: "device"},
+				"domain.interfaces.mtu": {Node: "domain.interfaces", Field: "mtu"},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.query)
+		qp, err := ParseQueryParams(params)
+		if err != nil {
+			t.Fatalf("test number %d: %v", i+1, err)
+		}
+		if got := qp.columnSources(); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("test number %d: expected %v, got %v", i+1, tc.expected, got)
+		}
+	}
+
+	qp := &QueryParams{MainNode: "domain.arp", Columns: []CatalogField{{Node: "domain.arp", Field: "mac"}}}
+	expected := map[string]ColumnSource{"mac": {Node: "domain.arp", Field: "mac"}}
+	if got := qp.columnSources(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
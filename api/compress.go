@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Responses with a smaller Content-Length are not worth compressing
+const minCompressSize = 1024
+
+// Content codings in the order the server prefers them when the client accepts several equally
+var contentEncodings = []string{"zstd", "br", "gzip"}
+
+// compressionLevel trades compression ratio for speed
+type compressionLevel int
+
+const (
+	// levelFast is used for query results, which are large and streamed while the query runs
+	levelFast compressionLevel = iota
+	// levelBest is used for static files and metadata, which are small and compress once per request
+	levelBest
+)
+
+// Media types that are compressed already or don't compress
+var incompressibleTypes = map[string]bool{
+	"application/vnd.apache.parquet":                                    true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": true,
+	"application/zip":          true,
+	"application/gzip":         true,
+	"application/zstd":         true,
+	"application/x-brotli":     true,
+	"application/octet-stream": true,
+	"application/pdf":          true,
+	"font/woff":                true,
+	"font/woff2":               true,
+}
+
+// Media types of query results, compressed for speed
+var streamedTypes = map[string]bool{
+	"application/json":                    true,
+	"application/x-ndjson":                true,
+	"text/csv":                            true,
+	"text/event-stream":                   true,
+	"application/vnd.apache.arrow.stream": true,
+}
+
+// levelFor returns the compression level of a media type, false when it isn't compressed
+func levelFor(contentType string) (compressionLevel, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case incompressibleTypes[mediaType]:
+		return 0, false
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"):
+		return 0, false
+	case streamedTypes[mediaType]:
+		return levelFast, true
+	}
+	return levelBest, true
+}
+
+// acceptEncoding returns the preferred content coding of the Accept-Encoding
+// header, empty when the response is sent uncompressed
+func acceptEncoding(header string) string {
+	qualities := map[string]float64{}
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(key)) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range contentEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressor is the writer of a content coding
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+// Pools of compressors by content coding and level, zstd encoders in particular are expensive to create
+var compressorPools = map[string][2]*sync.Pool{}
+
+func init() {
+	newPools := func(fast, best func() compressor) [2]*sync.Pool {
+		return [2]*sync.Pool{
+			levelFast: {New: func() interface{} { return fast() }},
+			levelBest: {New: func() interface{} { return best() }},
+		}
+	}
+	compressorPools["gzip"] = newPools(
+		func() compressor { w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed); return w },
+		func() compressor { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w },
+	)
+	compressorPools["zstd"] = newPools(
+		func() compressor {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+			return w
+		},
+		func() compressor {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(1))
+			return w
+		},
+	)
+	compressorPools["br"] = newPools(
+		func() compressor { return brotli.NewWriterLevel(nil, 1) },
+		func() compressor { return brotli.NewWriterLevel(nil, 6) },
+	)
+}
+
+// compressResponseWriter compresses the body once the header shows it is
+// worth it. The decision is taken when the header is written.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	decided  bool
+	writer   compressor
+	pool     *sync.Pool
+}
+
+func (cw *compressResponseWriter) WriteHeader(code int) {
+	if !cw.decided {
+		cw.decide(code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// decide starts compressing unless the response is empty, partial, encoded
+// already, small or of a type that doesn't compress
+func (cw *compressResponseWriter) decide(code int) {
+	cw.decided = true
+	header := cw.Header()
+
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < minCompressSize {
+		return
+	}
+	level, ok := levelFor(header.Get("Content-Type"))
+	if !ok {
+		return
+	}
+
+	cw.pool = compressorPools[cw.encoding][level]
+	cw.writer = cw.pool.Get().(compressor)
+	cw.writer.Reset(cw.ResponseWriter)
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", cw.encoding)
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.writer == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.writer.Write(b)
+}
+
+// Flush sends the compressed data written so far, so streamed results reach the client
+func (cw *compressResponseWriter) Flush() {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.writer != nil {
+		cw.writer.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets websocket style handlers take over the connection
+func (cw *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close ends the compressed body and returns the compressor to its pool
+func (cw *compressResponseWriter) close() {
+	if cw.writer == nil {
+		return
+	}
+	cw.writer.Close()
+	cw.writer.Reset(nil)
+	cw.pool.Put(cw.writer)
+	cw.writer = nil
+}
+
+// abort returns the compressor to its pool without ending the compressed body
+func (cw *compressResponseWriter) abort() {
+	if cw.writer == nil {
+		return
+	}
+	cw.writer.Reset(nil)
+	cw.pool.Put(cw.writer)
+	cw.writer = nil
+}
+
+// CompressionMiddleware compresses the responses of next with the content
+// coding the client prefers among zstd, brotli and gzip
+func CompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer func() {
+			// An aborted response, see encodeResponse, must not end like a complete one
+			if p := recover(); p != nil {
+				cw.abort()
+				panic(p)
+			}
+			cw.close()
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip;q=0.8", "gzip"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"*", "zstd"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"GZIP", "gzip"},
+	}
+
+	for i, tc := range testCases {
+		if encoding := acceptEncoding(tc.header); encoding != tc.expected {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.expected, encoding)
+		}
+	}
+}
+
+func TestLevelFor(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		level       compressionLevel
+		compress    bool
+	}{
+		{"application/json", levelFast, true},
+		{"text/csv; charset=utf-8", levelFast, true},
+		{"application/vnd.apache.arrow.stream", levelFast, true},
+		{"text/html; charset=utf-8", levelBest, true},
+		{"image/svg+xml", levelBest, true},
+		{"application/vnd.apache.parquet", 0, false},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", 0, false},
+		{"image/png", 0, false},
+		{"", 0, false},
+	}
+
+	for i, tc := range testCases {
+		level, compress := levelFor(tc.contentType)
+		if compress != tc.compress || level != tc.level {
+			t.Errorf("test number %d: expected %v %v, got %v %v", i, tc.level, tc.compress, level, compress)
+		}
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	body := strings.Repeat(`{"device":"eth0","ip_address":"10.0.0.1"},`, 1000)
+	serve := func(contentType string, contentLength bool) http.Handler {
+		return CompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			if contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			io.WriteString(w, body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, body[len(body)/2:])
+		}))
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+	}
+
+	testCases := []struct {
+		acceptEncoding string
+		contentType    string
+		contentLength  bool
+		encoding       string
+	}{
+		{"gzip", "application/json", false, "gzip"},
+		{"zstd", "text/csv", false, "zstd"},
+		{"br", "text/html; charset=utf-8", true, "br"},
+		{"", "application/json", false, ""},
+		{"gzip, br, zstd", "application/vnd.apache.parquet", false, ""},
+	}
+
+	for i, tc := range testCases {
+		r := httptest.NewRequest("GET", "/api/gen/?dn=domain.arp", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		serve(tc.contentType, tc.contentLength).ServeHTTP(w, r)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tc.encoding {
+			t.Errorf("test number %d: expected encoding %q, got %q", i, tc.encoding, encoding)
+			continue
+		}
+		if tc.encoding != "" && w.Header().Get("Content-Length") != "" {
+			t.Errorf("test number %d: expected no Content-Length on a compressed body", i)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("test number %d: expected Vary: Accept-Encoding", i)
+		}
+
+		reader, err := decoders[tc.encoding](bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Errorf("test number %d: %v", i, err)
+			continue
+		}
+		decoded, err := io.ReadAll(reader)
+		if err != nil || string(decoded) != body {
+			t.Errorf("test number %d: body doesn't round trip: %v", i, err)
+		}
+	}
+}
+
+func TestCompressionMiddlewareSmallBody(t *testing.T) {
+	handler := CompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "2")
+		io.WriteString(w, "[]")
+	}))
+
+	r := httptest.NewRequest("GET", "/api/help/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "[]" {
+		t.Errorf("expected a small body to be sent uncompressed, got %q", w.Body.String())
+	}
+}
+
+func TestStreamErrorOverHTTP(t *testing.T) {
+	rows := make([][]driver.Value, 2000)
+	for i := range rows {
+		rows[i] = []driver.Value{"eth" + strconv.Itoa(i)}
+	}
+	results := map[string]fakeResult{
+		"complete": {Columns: []string{"device"}, Rows: rows},
+		"failing":  {Columns: []string{"device"}, Rows: rows, Err: errors.New("timeout")},
+	}
+	server := httptest.NewServer(CompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := results[r.URL.Query().Get("result")]
+		encodeResponse(w, queryFake(t, result), &RequestData{Format: r.URL.Query().Get("format")})
+	})))
+	defer server.Close()
+
+	testCases := []struct {
+		query     string
+		encoding  string
+		status    string
+		readError bool
+	}{
+		{"result=complete&format=csv", "", "complete", false},
+		{"result=complete&format=csv", "gzip", "complete", false},
+		{"result=failing&format=json", "gzip", "error", false},
+		{"result=failing&format=csv", "", "", true},
+		{"result=failing&format=csv", "gzip", "", true},
+	}
+
+	for i, tc := range testCases {
+		request, _ := http.NewRequest("GET", server.URL+"/?"+tc.query, nil)
+		if tc.encoding != "" {
+			request.Header.Set("Accept-Encoding", tc.encoding)
+		}
+		response, err := http.DefaultTransport.RoundTrip(request)
+		if err != nil {
+			t.Fatalf("test number %d: %v", i, err)
+		}
+		var body io.Reader = response.Body
+		if response.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gzip.NewReader(response.Body); err != nil {
+				t.Fatalf("test number %d: %v", i, err)
+			}
+		}
+		_, err = io.Copy(io.Discard, body)
+		response.Body.Close()
+
+		if (err != nil) != tc.readError {
+			t.Errorf("test number %d: unexpected read error %v", i, err)
+		}
+		if status := response.Trailer.Get(trailerStatus); status != tc.status {
+			t.Errorf("test number %d: expected %s %q, got %q", i, trailerStatus, tc.status, status)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+// The SQL console is only served when this environment variable is "true"
+const SQL_CONSOLE_ENV = "DSM_SQL_CONSOLE"
+
+// Header with the comma separated read groups of the caller, set by the proxy in front of the API
+const READ_GROUPS_HEADER = "X-Read-Groups"
+
+// The read groups are only trusted when the proxy sends the secret of this
+// environment variable in the proxy secret header. Without it the console is refused.
+const SQL_CONSOLE_PROXY_SECRET_ENV = "DSM_SQL_CONSOLE_PROXY_SECRET"
+
+const PROXY_SECRET_HEADER = "X-Proxy-Secret"
+
+const SQL_CONSOLE_TIMEOUT = 30 * time.Second
+
+// Functions a console statement can call. Everything else is refused, many
+// catalog functions have side effects even in a READ ONLY transaction, or run
+// a query given as text and so bypass the validation. The names include the
+// functions the parser uses for SQL syntax such as EXTRACT, TRIM or AT TIME ZONE.
+var consoleAllowedFunctions = stringSet(
+	// aggregates
+	"count", "sum", "avg", "min", "max", "array_agg", "string_agg", "bool_and", "bool_or", "every",
+	"json_agg", "jsonb_agg", "json_object_agg", "jsonb_object_agg", "stddev", "stddev_pop", "stddev_samp",
+	"variance", "var_pop", "var_samp", "percentile_cont", "percentile_disc", "mode",
+	// window functions
+	"row_number", "rank", "dense_rank", "percent_rank", "cume_dist", "ntile", "lag", "lead",
+	"first_value", "last_value", "nth_value",
+	// strings
+	"lower", "upper", "initcap", "length", "char_length", "character_length", "octet_length",
+	"substring", "substr", "position", "strpos", "starts_with", "left", "right", "lpad", "rpad",
+	"btrim", "ltrim", "rtrim", "replace", "translate", "reverse", "repeat", "concat", "concat_ws",
+	"split_part", "format", "md5", "regexp_replace", "regexp_match", "regexp_matches", "regexp_like",
+	"regexp_count", "regexp_split_to_array", "regexp_split_to_table", "string_to_array",
+	"array_to_string", "overlay", "normalize", "quote_ident", "quote_literal", "to_char", "to_number",
+	// numbers
+	"abs", "round", "ceil", "ceiling", "floor", "trunc", "mod", "power", "sqrt", "sign", "div",
+	"width_bucket",
+	// dates and times
+	"now", "date_trunc", "date_part", "extract", "age", "timezone", "to_timestamp", "to_date",
+	"make_date", "make_time", "make_timestamp", "make_timestamptz", "make_interval", "date_bin",
+	"justify_days", "justify_hours", "justify_interval", "isfinite", "overlaps",
+	// arrays and sets
+	"array_length", "array_lower", "array_upper", "array_ndims", "cardinality", "unnest",
+	"array_position", "array_positions", "array_remove", "array_replace", "array_append",
+	"array_prepend", "array_cat", "generate_series", "generate_subscripts",
+	// json
+	"to_json", "to_jsonb", "row_to_json", "array_to_json", "json_build_object", "jsonb_build_object",
+	"json_build_array", "jsonb_build_array", "json_array_elements", "jsonb_array_elements",
+	"json_array_elements_text", "jsonb_array_elements_text", "json_each", "jsonb_each",
+	"json_each_text", "jsonb_each_text", "json_object_keys", "jsonb_object_keys",
+	"json_array_length", "jsonb_array_length", "json_typeof", "jsonb_typeof",
+	"json_extract_path", "jsonb_extract_path", "json_extract_path_text", "jsonb_extract_path_text",
+	"jsonb_path_query", "jsonb_path_query_array", "jsonb_path_query_first", "jsonb_path_exists",
+	"jsonb_path_match", "jsonb_strip_nulls", "jsonb_pretty", "jsonb_set",
+	// network addresses
+	"host", "hostmask", "masklen", "netmask", "network", "broadcast", "family", "abbrev",
+	"set_masklen", "inet_same_family", "inet_merge", "text",
+	// text search
+	"to_tsvector", "to_tsquery", "plainto_tsquery", "phraseto_tsquery", "websearch_to_tsquery",
+	"ts_rank", "ts_rank_cd", "ts_headline",
+)
+
+func stringSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Parse tree nodes that are never allowed in a console statement
+var consoleDeniedNodes = map[string]string{
+	"InsertStmt":    "INSERT",
+	"UpdateStmt":    "UPDATE",
+	"DeleteStmt":    "DELETE",
+	"MergeStmt":     "MERGE",
+	"intoClause":    "SELECT INTO",
+	"lockingClause": "row locking",
+	"ParamRef":      "parameters",
+}
+
+// Schemas that can be referenced explicitly, they hold no node rows
+var consoleAllowedSchemas = map[string]bool{"information_schema": true}
+
+type consoleInspector struct {
+	relations map[string]bool
+	ctes      map[string]bool
+	err       error
+}
+
+func (c *consoleInspector) fail(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (c *consoleInspector) walk(node interface{}) {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, child := range n {
+			c.walk(child)
+		}
+	case map[string]interface{}:
+		for key, child := range n {
+			if what, denied := consoleDeniedNodes[key]; denied {
+				c.fail("%s is not allowed", what)
+			}
+
+			switch key {
+			case "RangeVar":
+				c.inspectRelation(child)
+			case "CommonTableExpr":
+				if cte, ok := child.(map[string]interface{}); ok {
+					if name, ok := cte["ctename"].(string); ok {
+						c.ctes[name] = true
+					}
+				}
+			case "FuncCall":
+				c.inspectFunction(child)
+			}
+			c.walk(child)
+		}
+	}
+}
+
+func (c *consoleInspector) inspectRelation(node interface{}) {
+	rangeVar, _ := node.(map[string]interface{})
+	relation, _ := rangeVar["relname"].(string)
+	schema, _ := rangeVar["schemaname"].(string)
+
+	if schema != "" {
+		if !consoleAllowedSchemas[schema] {
+			c.fail("schema %s is not allowed", schema)
+		}
+		return
+	}
+	c.relations[relation] = true
+}
+
+func (c *consoleInspector) inspectFunction(node interface{}) {
+	funcCall, _ := node.(map[string]interface{})
+	names, _ := funcCall["funcname"].([]interface{})
+	if len(names) == 0 {
+		return
+	}
+
+	// The last part is the function name, the schema does not matter
+	last, _ := names[len(names)-1].(map[string]interface{})
+	str, _ := last["String"].(map[string]interface{})
+	name, _ := str["sval"].(string)
+	name = strings.ToLower(name)
+
+	if !consoleAllowedFunctions[name] {
+		c.fail("function %s is not allowed", name)
+	}
+}
+
+// ConsoleStatement is a validated console statement with the relations and CTEs it names
+type ConsoleStatement struct {
+	SQL       string
+	Relations []string
+	CTEs      map[string]bool
+}
+
+// ValidateConsoleSQL parses the statement with the Postgres parser and only
+// accepts a single SELECT or WITH without side effects.
+func ValidateConsoleSQL(statement string) (*ConsoleStatement, error) {
+	tree, err := pg_query.ParseToJSON(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Stmts []struct {
+			Stmt map[string]interface{} `json:"stmt"`
+		} `json:"stmts"`
+	}
+	if err := json.Unmarshal([]byte(tree), &parsed); err != nil {
+		return nil, err
+	}
+
+	if len(parsed.Stmts) != 1 {
+		return nil, fmt.Errorf("expected a single statement, got %d", len(parsed.Stmts))
+	}
+	if _, ok := parsed.Stmts[0].Stmt["SelectStmt"]; !ok {
+		return nil, fmt.Errorf("only SELECT and WITH statements are allowed")
+	}
+
+	inspector := &consoleInspector{relations: map[string]bool{}, ctes: map[string]bool{}}
+	inspector.walk(parsed.Stmts[0].Stmt)
+	if inspector.err != nil {
+		return nil, inspector.err
+	}
+
+	relations := []string{}
+	for relation := range inspector.relations {
+		relations = append(relations, relation)
+	}
+	sort.Strings(relations)
+	return &ConsoleStatement{SQL: statement, Relations: relations, CTEs: inspector.ctes}, nil
+}
+
+// ConstructConsoleQuery wraps the statement with CTEs that shadow every
+// restricted node, so only rows readable by one of the groups are seen.
+func ConstructConsoleQuery(stmt *ConsoleStatement, nodes map[string]bool, groups []string) (string, []interface{}, error) {
+	// A CTE named after a node would hide the node from the shadowing CTE
+	for cte := range stmt.CTEs {
+		if _, ok := nodes[cte]; ok {
+			return "", nil, fmt.Errorf("CTE %s has the name of a node", cte)
+		}
+	}
+
+	shadows := []string{}
+	for _, relation := range stmt.Relations {
+		if stmt.CTEs[relation] {
+			continue
+		}
+		restricted, ok := nodes[relation]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown node: %s", relation)
+		}
+		if restricted {
+			shadows = append(shadows, fmt.Sprintf("%s AS (SELECT * FROM public.%s WHERE %s && $1::text[])",
+				pq.QuoteIdentifier(relation), pq.QuoteIdentifier(relation), pq.QuoteIdentifier(META_RBAC_KEY)))
+		}
+	}
+
+	// The newline ends a trailing comment of the statement
+	query := fmt.Sprintf("SELECT * FROM (%s\n) AS console", trimQuery(stmt.SQL))
+	if len(shadows) == 0 {
+		return query, nil, nil
+	}
+	return fmt.Sprintf("WITH %s %s", strings.Join(shadows, ", "), query), []interface{}{pq.Array(groups)}, nil
+}
+
+// checkProxySecret reports whether the request comes through the proxy that
+// sets the read groups, by comparing the proxy secret in constant time.
+func checkProxySecret(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(PROXY_SECRET_HEADER)), []byte(secret)) == 1
+}
+
+func parseReadGroups(r *http.Request) []string {
+	groups := []string{}
+	for _, group := range strings.Split(r.Header.Get(READ_GROUPS_HEADER), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// SQLConsoleHandler runs a single read only statement from the q parameter
+// or the request body, in a READ ONLY transaction with a timeout.
+func SQLConsoleHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkProxySecret(r, os.Getenv(SQL_CONSOLE_PROXY_SECRET_ENV)) {
+		http.Error(w, "the SQL console is only served through the proxy", http.StatusForbidden)
+		return
+	}
+
+	reqData, err := parseInputGen(r)
+	if err == nil {
+		err = checkGenOnlyFormat(reqData.Format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	statement := r.URL.Query().Get("q")
+	if statement == "" && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		statement = string(body)
+	}
+
+	stmt, err := ValidateConsoleSQL(statement)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	nodes, err := loadNodeReadGroups()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	query, params, err := ConstructConsoleQuery(stmt, nodes, parseReadGroups(r))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), SQL_CONSOLE_TIMEOUT)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", SQL_CONSOLE_TIMEOUT.Milliseconds())); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, reqData.groupQuery(query), params...)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	defer rows.Close()
+
+	encodeResponse(w, rows, reqData)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateConsoleSQL(t *testing.T) {
+	testCases := []struct {
+		Input     string
+		Relations []string
+		Err       bool
+	}{
+		{Input: `SELECT * FROM "domain.arp"`, Relations: []string{"domain.arp"}},
+		{Input: `SELECT * FROM "domain.arp" a JOIN standard s ON s.id = a.standard_id;`, Relations: []string{"domain.arp", "standard"}},
+		{Input: `WITH ips AS (SELECT ip_address FROM "domain.arp") SELECT count(*) FROM ips`, Relations: []string{"domain.arp", "ips"}},
+		{Input: `SELECT * FROM information_schema.columns`, Relations: []string{}},
+		{Input: `SELECT 1; SELECT 2`, Err: true},
+		{Input: `DELETE FROM "domain.arp"`, Err: true},
+		{Input: `WITH d AS (DELETE FROM "domain.arp" RETURNING *) SELECT * FROM d`, Err: true},
+		{Input: `SELECT * INTO copy FROM "domain.arp"`, Err: true},
+		{Input: `SELECT * FROM "domain.arp" FOR UPDATE`, Err: true},
+		{Input: `SELECT set_config('role', 'x', false)`, Err: true},
+		{Input: `SELECT pg_catalog.pg_sleep(10)`, Err: true},
+		{Input: `SELECT query_to_xml('SELECT * FROM "domain.arp"', true, true, '')`, Err: true},
+		{Input: `SELECT * FROM ts_stat('SELECT to_tsvector(device) FROM "domain.arp"')`, Err: true},
+		{Input: `SELECT ts_rewrite('a'::tsquery, 'SELECT t, s FROM "domain.arp"')`, Err: true},
+		{Input: `SELECT pg_stat_reset()`, Err: true},
+		{Input: `SELECT pg_stat_reset_shared('bgwriter')`, Err: true},
+		{Input: `SELECT pg_promote()`, Err: true},
+		{Input: `SELECT pg_wal_replay_pause()`, Err: true},
+		{Input: `SELECT pg_log_backend_memory_contexts(1)`, Err: true},
+		{Input: `SELECT device, count(*), max(extract(epoch FROM now() - seen_at)) FROM "domain.arp" GROUP BY device`, Relations: []string{"domain.arp"}},
+		{Input: `SELECT trim(device), host(ip_address), row_number() OVER () FROM "domain.arp"`, Relations: []string{"domain.arp"}},
+		{Input: `SELECT * FROM public."domain.arp"`, Err: true},
+		{Input: `SELECT * FROM pg_catalog.pg_stats`, Err: true},
+		{Input: `SELECT * FROM "domain.arp" WHERE device = $1`, Err: true},
+		{Input: `SELEC 1`, Err: true},
+	}
+
+	for testNum, testCase := range testCases {
+		stmt, err := ValidateConsoleSQL(testCase.Input)
+		if testCase.Err {
+			if err == nil {
+				t.Errorf("test number %d: expected an error for %s", testNum+1, testCase.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test number %d: unexpected error %v", testNum+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(stmt.Relations, testCase.Relations) {
+			t.Errorf("test number %d: expected relations %v but got %v", testNum+1, testCase.Relations, stmt.Relations)
+		}
+	}
+}
+
+func TestConstructConsoleQuery(t *testing.T) {
+	nodes := map[string]bool{"domain.arp": true, "standard": true, "unrestricted": false}
+
+	stmt, err := ValidateConsoleSQL(`SELECT * FROM "domain.arp" -- all rows`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, params, err := ConstructConsoleQuery(stmt, nodes, []string{"admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WITH \"domain.arp\" AS (SELECT * FROM public.\"domain.arp\" WHERE \"__meta__rbac_read_groups\" && $1::text[]) SELECT * FROM (SELECT * FROM \"domain.arp\" -- all rows\n) AS console"
+	if query != expected {
+		t.Errorf("expected %s but got %s", expected, query)
+	}
+	if len(params) != 1 {
+		t.Errorf("expected the read groups as parameter, got %v", params)
+	}
+
+	stmt, _ = ValidateConsoleSQL(`SELECT * FROM unrestricted`)
+	query, params, err = ConstructConsoleQuery(stmt, nodes, nil)
+	if err != nil || strings.HasPrefix(query, "WITH") || params != nil {
+		t.Errorf("expected no shadowing for an unrestricted node, got %s %v %v", query, params, err)
+	}
+
+	stmt, _ = ValidateConsoleSQL(`SELECT * FROM secrets`)
+	if _, _, err := ConstructConsoleQuery(stmt, nodes, nil); err == nil {
+		t.Errorf("expected an error for an unknown relation")
+	}
+
+	stmt, _ = ValidateConsoleSQL(`WITH x AS (SELECT * FROM "domain.arp"), "domain.arp" AS (SELECT 1) SELECT * FROM x`)
+	if _, _, err := ConstructConsoleQuery(stmt, nodes, nil); err == nil {
+		t.Errorf("expected an error for a CTE named after a node")
+	}
+}
+
+func TestSQLConsoleProxySecret(t *testing.T) {
+	testCases := []struct {
+		Secret string
+		Header string
+		Code   int
+	}{
+		{Secret: "", Header: "", Code: 403},
+		{Secret: "", Header: "anything", Code: 403},
+		{Secret: "s3cret", Header: "", Code: 403},
+		{Secret: "s3cret", Header: "wrong", Code: 403},
+		{Secret: "s3cret", Header: "s3cret", Code: 400},
+	}
+
+	defer os.Unsetenv(SQL_CONSOLE_PROXY_SECRET_ENV)
+	for testNum, testCase := range testCases {
+		os.Setenv(SQL_CONSOLE_PROXY_SECRET_ENV, testCase.Secret)
+		r := httptest.NewRequest("GET", "/api/sql/?q=SELEC", nil)
+		if testCase.Header != "" {
+			r.Header.Set(PROXY_SECRET_HEADER, testCase.Header)
+		}
+		w := httptest.NewRecorder()
+		SQLConsoleHandler(w, r)
+		if w.Code != testCase.Code {
+			t.Errorf("test number %d: expected %d but got %d %s", testNum+1, testCase.Code, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Rendering of array values in CSV
+const (
+	// arraysPostgres writes the Postgres array literal, e.g. {a,b}
+	arraysPostgres = "postgres"
+	// arraysJSON writes a JSON array, e.g. ["a","b"]
+	arraysJSON = "json"
+	// arraysJoined writes the elements separated by the array separator, e.g. a;b
+	arraysJoined = "joined"
+)
+
+// Delimiters by name, a single delimiter character is accepted too
+var csvDelimiters = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+	"pipe":      '|',
+}
+
+// CSVDialect is the shape of CSV output
+type CSVDialect struct {
+	Delimiter rune
+	Header    bool
+	Null      string
+	Arrays    string
+	ArraySep  string
+	BOM       bool
+}
+
+// CSVOptions are the dialect options of a request, nil or empty when not given
+type CSVOptions struct {
+	Delimiter rune
+	Header    *bool
+	Null      *string
+	Arrays    string
+	ArraySep  *string
+	BOM       *bool
+}
+
+// parseCSVOptions parses delimiter, header, null, arrays, arraysep and bom
+func parseCSVOptions(params url.Values) (*CSVOptions, error) {
+	options := &CSVOptions{}
+
+	if value := params.Get("delimiter"); value != "" {
+		delimiter, ok := csvDelimiters[strings.ToLower(value)]
+		if !ok && utf8.RuneCountInString(value) == 1 {
+			delimiter, _ = utf8.DecodeRuneInString(value)
+			ok = delimiter != '"' && delimiter != '\r' && delimiter != '\n' && delimiter != utf8.RuneError
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid delimiter value: %s. Allowed is comma, semicolon, tab, pipe or a single character", value)
+		}
+		options.Delimiter = delimiter
+	}
+
+	parseBool := func(name string) (*bool, error) {
+		value := params.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %s. Only true or false is allowed", name, value)
+		}
+		return &b, nil
+	}
+	var err error
+	if options.Header, err = parseBool("header"); err != nil {
+		return nil, err
+	}
+	if options.BOM, err = parseBool("bom"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := params["null"]; ok {
+		null := params.Get("null")
+		options.Null = &null
+	}
+	if _, ok := params["arraysep"]; ok {
+		sep := params.Get("arraysep")
+		options.ArraySep = &sep
+	}
+
+	switch value := params.Get("arrays"); value {
+	case "", arraysPostgres, arraysJSON, arraysJoined:
+		options.Arrays = value
+	default:
+		return nil, fmt.Errorf("invalid arrays value: %s. Only postgres, json or joined is allowed", value)
+	}
+	return options, nil
+}
+
+// apply returns the dialect with the options of the request set
+func (d CSVDialect) apply(options *CSVOptions) CSVDialect {
+	if options == nil {
+		return d
+	}
+	if options.Delimiter != 0 {
+		d.Delimiter = options.Delimiter
+	}
+	if options.Header != nil {
+		d.Header = *options.Header
+	}
+	if options.Null != nil {
+		d.Null = *options.Null
+	}
+	if options.Arrays != "" {
+		d.Arrays = options.Arrays
+	}
+	if options.ArraySep != nil {
+		d.ArraySep = *options.ArraySep
+	}
+	if options.BOM != nil {
+		d.BOM = *options.BOM
+	}
+	return d
+}
+
+// value renders a value as scanned from lib/pq after its database type
+func (d *CSVDialect) value(dbType string, v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return d.Null
+	case time.Time:
+		return jsonTime(dbType, value)
+	case []byte:
+		if dbType == "BYTEA" {
+			return `\x` + hex.EncodeToString(value)
+		}
+		if strings.HasPrefix(dbType, "_") {
+			return d.array(dbType, string(value))
+		}
+		return string(value)
+	case string:
+		return value
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// array renders an array literal in the array mode of the dialect. Arrays
+// that don't parse, such as multi dimensional ones, keep their literal.
+func (d *CSVDialect) array(dbType string, literal string) string {
+	switch d.Arrays {
+	case arraysJSON:
+		valueJSON, err := json.Marshal(newJSONDecoder(dbType, false)(literal))
+		if err == nil {
+			return string(valueJSON)
+		}
+	case arraysJoined:
+		elements := []sql.NullString{}
+		if err := (pq.GenericArray{A: &elements}).Scan([]byte(literal)); err == nil {
+			texts := make([]string, len(elements))
+			for i, element := range elements {
+				texts[i] = element.String
+				if !element.Valid {
+					texts[i] = d.Null
+				}
+			}
+			return strings.Join(texts, d.ArraySep)
+		}
+	}
+	return literal
+}
+
+// csvEncoder writes CSV in its dialect, changed by the options of the request
+type csvEncoder struct {
+	mediaType string
+	extension string
+	dialect   CSVDialect
+}
+
+func (e csvEncoder) MediaType() string { return e.mediaType }
+
+func (e csvEncoder) Encode(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	dialect := e.dialect.apply(requestData.CSV)
+
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, "Failed to get columns: "+err.Error(), 500)
+		return nil
+	}
+	types := make([]string, len(s.Types))
+	for i, ct := range s.Types {
+		types[i] = strings.ToUpper(ct.DatabaseTypeName())
+	}
+
+	w.Header().Set("Content-Disposition", attachment(requestData, e.extension))
+	const bufferSize = 2 * 1024 * 1024 // 2MB
+	bw := bufio.NewWriterSize(w, bufferSize)
+	defer bw.Flush()
+	writer := csv.NewWriter(bw)
+	writer.Comma = dialect.Delimiter
+	defer writer.Flush()
+
+	if dialect.BOM {
+		bw.WriteString("\ufeff")
+	}
+	if dialect.Header {
+		if err := writer.Write(s.VisibleColumns()); err != nil {
+			return err
+		}
+	}
+
+	row := make([]string, len(s.Visible))
+	for s.Next() {
+		for n, i := range s.Visible {
+			row[n] = dialect.value(types[i], s.Values[i])
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Characters kept in attachment filenames
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// attachment returns the Content-Disposition of a download named after the
+// node or endpoint of the request, data when there is none
+func attachment(requestData *RequestData, extension string) string {
+	name := unsafeFilename.ReplaceAllString(requestData.Name, "_")
+	if strings.Trim(name, "._") == "" {
+		name = "data"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + extension})
+}
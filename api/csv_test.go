@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseCSVOptions(t *testing.T) {
+	testCases := []struct {
+		query string
+		err   bool
+	}{
+		{"", false},
+		{"delimiter=tab&header=false&null=NULL&arrays=json&bom=true", false},
+		{"delimiter=%3B&arrays=joined&arraysep=%7C", false},
+		{"delimiter=ab", true},
+		{"delimiter=%22", true},
+		{"header=maybe", true},
+		{"arrays=xml", true},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.query)
+		if _, err := parseCSVOptions(params); (err != nil) != tc.err {
+			t.Errorf("test number %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "groups", "seen"},
+		Types:   []string{"TEXT", "_TEXT", "DATE"},
+		Rows: [][]driver.Value{
+			{"eth0", []byte(`{ops,"a,b",NULL}`), nil},
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		query    string
+		name     string
+		expected string
+		filename string
+	}{
+		{"csv", "", "domain.arp", "device,groups,seen\neth0,\"{ops,\"\"a,b\"\",NULL}\",\n", "domain.arp.csv"},
+		{"csv", "header=false&arrays=json&null=NULL", "", "eth0,\"[\"\"ops\"\",\"\"a,b\"\",null]\",NULL\n", "data.csv"},
+		{"csv", "delimiter=semicolon&arrays=joined&arraysep=|&bom=true", "arp", "\ufeffdevice;groups;seen\neth0;ops|a,b|;\n", "arp.csv"},
+		{"tsv", "", "domain.arp", "device\tgroups\tseen\neth0\t\"{ops,\"\"a,b\"\",NULL}\"\t\n", "domain.arp.tsv"},
+		{"csv3", "", "../etc/passwd", "device,groups,seen\neth0,\"ops;a,b;<nil>\",<nil>\n", ".._etc_passwd.csv"},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.query)
+		options, err := parseCSVOptions(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		encodeResponse(w, queryFake(t, result), &RequestData{Format: tc.format, CSV: options, Name: tc.name})
+		if w.Body.String() != tc.expected {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.expected, w.Body.String())
+		}
+		if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename="+tc.filename {
+			t.Errorf("test number %d: unexpected disposition %s", i, disposition)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Marks the side a diff row comes from, it is not part of the output
+const diffPresentColumn = "__diff_present"
+
+// offsetPlaceholders renumbers the filter placeholders to follow offset
+// values, so the query can be combined with another query.
+func offsetPlaceholders(qp *QueryParams, offset int) {
+	for i := range qp.Filters {
+		qp.Filters[i].Placeholder = fmt.Sprintf("$%d", offset+i+1)
+	}
+}
+
+// parseDiffQuery builds one side of the diff from its url encoded gen query
+func parseDiffQuery(rawQuery string, offset int, catalog []CatalogField) (string, []interface{}, error) {
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, err
+	}
+
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		return "", nil, err
+	}
+	if qp.MainTable == "" {
+		return "", nil, fmt.Errorf("missing main table")
+	}
+	if len(qp.Lists) > 0 {
+		return "", nil, fmt.Errorf("value lists are only supported on /api/gen")
+	}
+
+	offsetPlaceholders(qp, offset)
+	qp.useCatalog(catalog)
+	query, values := BuildQuery(qp)
+	return query, values, nil
+}
+
+// ConstructDiffQuery compares the rows of query a (old) with query b (new) on
+// the key columns. Rows only in b are added, rows only in a are removed and
+// rows on both sides with other values are changed. Changed rows carry the
+// old values in previous_<column> columns.
+func ConstructDiffQuery(queryA, queryB string, columns []SubQueryColumn, keys []string) (string, error) {
+	if len(keys) == 0 {
+		return "", fmt.Errorf("diff expects at least one key")
+	}
+
+	known := map[string]bool{}
+	for _, column := range columns {
+		known[column.Name] = true
+	}
+	for _, key := range keys {
+		if !known[key] {
+			return "", fmt.Errorf("unknown key column: %s", key)
+		}
+	}
+
+	present := pq.QuoteIdentifier(diffPresentColumn)
+	selects := []string{fmt.Sprintf(
+		"CASE WHEN o.%s IS NULL THEN 'added' WHEN n.%s IS NULL THEN 'removed' ELSE 'changed' END AS change_type",
+		present, present)}
+	previous := []string{}
+	for _, column := range columns {
+		name := pq.QuoteIdentifier(column.Name)
+		selects = append(selects, fmt.Sprintf("CASE WHEN n.%s THEN n.%s ELSE o.%s END AS %s", present, name, name, name))
+		if !containsString(keys, column.Name) {
+			previous = append(previous, fmt.Sprintf("CASE WHEN n.%s THEN o.%s END AS %s",
+				present, name, pq.QuoteIdentifier("previous_"+column.Name)))
+		}
+	}
+	selects = append(selects, previous...)
+
+	// FULL JOIN needs a hashable condition, rows with a NULL key show up as removed and added
+	conditions := make([]string, len(keys))
+	orderParts := make([]string, len(keys))
+	for i, key := range keys {
+		name := pq.QuoteIdentifier(key)
+		conditions[i] = fmt.Sprintf("n.%s = o.%s", name, name)
+		orderParts[i] = fmt.Sprintf("coalesce(n.%s, o.%s)", name, name)
+	}
+
+	query := fmt.Sprintf(`WITH diff_a AS (%s), diff_b AS (%s)
+SELECT %s
+FROM (SELECT true AS %s, * FROM (SELECT * FROM diff_b EXCEPT SELECT * FROM diff_a) AS added) AS n
+FULL JOIN (SELECT true AS %s, * FROM (SELECT * FROM diff_a EXCEPT SELECT * FROM diff_b) AS removed) AS o
+ON %s
+ORDER BY %s`,
+		trimQuery(queryA), trimQuery(queryB), strings.Join(selects, ", "), present, present,
+		strings.Join(conditions, " AND "), strings.Join(orderParts, ", "))
+	return query, nil
+}
+
+func containsString(list []string, item string) bool {
+	for _, s := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+func sameColumns(a, b []SubQueryColumn) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+func DiffHandler(w http.ResponseWriter, r *http.Request) {
+	reqData, err := parseInputGen(r)
+	if err == nil {
+		err = checkGenOnlyFormat(reqData.Format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	catalog, err := loadCatalog(DB)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	urlQueryParams := r.URL.Query()
+	queryA, params, err := parseDiffQuery(urlQueryParams.Get("a"), 0, catalog)
+	if err != nil {
+		http.Error(w, "query a: "+err.Error(), 400)
+		return
+	}
+	// b is numbered from $1 to learn its columns on its own
+	queryB, paramsB, err := parseDiffQuery(urlQueryParams.Get("b"), 0, catalog)
+	if err != nil {
+		http.Error(w, "query b: "+err.Error(), 400)
+		return
+	}
+
+	columnsA, err := subQueryColumns(DB, queryA, params)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	columnsB, err := subQueryColumns(DB, queryB, paramsB)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !sameColumns(columnsA, columnsB) {
+		http.Error(w, "query a and b must return the same columns", 400)
+		return
+	}
+
+	queryB, paramsB, err = parseDiffQuery(urlQueryParams.Get("b"), len(params), catalog)
+	if err != nil {
+		http.Error(w, "query b: "+err.Error(), 400)
+		return
+	}
+
+	query, err := ConstructDiffQuery(queryA, queryB, columnsA, urlQueryParams["key"])
+	log.Printf("query %s: diff %s", reqData.QueryID, query)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rows, err := DB.Query(reqData.groupQuery(query), append(params, paramsB...)...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	encodeResponse(w, rows, reqData)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiffQueryOffset(t *testing.T) {
+	query, values, err := parseDiffQuery("dn=domain.packages&field=domain.packages.name&filter=match:domain.packages.standard_id:b", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "domain_packages.standard_id = $3") {
+		t.Errorf("expected the placeholder to follow the offset, got %s", query)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"b"}) {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	if _, _, err := parseDiffQuery("field=domain.packages.name", 0, nil); err == nil {
+		t.Errorf("expected an error for a query without dn")
+	}
+}
+
+func TestConstructDiffQuery(t *testing.T) {
+	columns := []SubQueryColumn{{Name: "name"}, {Name: "version"}}
+
+	query, err := ConstructDiffQuery("SELECT a", "SELECT b", columns, []string{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`WITH diff_a AS (SELECT a), diff_b AS (SELECT b)`,
+		`CASE WHEN o."__diff_present" IS NULL THEN 'added' WHEN n."__diff_present" IS NULL THEN 'removed' ELSE 'changed' END AS change_type`,
+		`CASE WHEN n."__diff_present" THEN n."version" ELSE o."version" END AS "version"`,
+		`CASE WHEN n."__diff_present" THEN o."version" END AS "previous_version"`,
+		`ON n."name" = o."name"`,
+		`ORDER BY coalesce(n."name", o."name")`,
+	}
+	for _, part := range expected {
+		if !strings.Contains(query, part) {
+			t.Errorf("expected %s in %s", part, query)
+		}
+	}
+	if strings.Contains(query, "previous_name") {
+		t.Errorf("key columns should not have a previous column: %s", query)
+	}
+
+	if _, err := ConstructDiffQuery("SELECT a", "SELECT b", columns, []string{"hostname"}); err == nil {
+		t.Errorf("expected an error for an unknown key")
+	}
+	if _, err := ConstructDiffQuery("SELECT a", "SELECT b", columns, nil); err == nil {
+		t.Errorf("expected an error without keys")
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoder writes the rows of a query in an output format
+type Encoder interface {
+	// MediaType is the Content-Type of the output
+	MediaType() string
+	// Encode answers errors before the output starts with http.Error. It
+	// returns the error that ended the output after the header was sent,
+	// see encodeResponse.
+	Encode(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error
+}
+
+// EncoderFunc is an Encoder writing mediaType with encode
+type EncoderFunc struct {
+	mediaType string
+	encode    func(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error
+}
+
+func (e EncoderFunc) MediaType() string { return e.mediaType }
+
+func (e EncoderFunc) Encode(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	return e.encode(w, rows, requestData)
+}
+
+var (
+	// Encoders by format name
+	encoders = map[string]Encoder{}
+	// Former format names that map onto a registered format
+	formatAliases = map[string]string{}
+	// Formats chosen by media type, through format=<media type> or the
+	// Accept header. The first registered format of a media type is chosen.
+	mediaTypeFormats = map[string]string{}
+	// Media types in the order the server prefers them when the Accept header doesn't decide
+	mediaTypes = []string{}
+)
+
+// RegisterEncoder makes encoder available as format=<format> and under the former names in aliases
+func RegisterEncoder(format string, encoder Encoder, aliases ...string) {
+	encoders[format] = encoder
+	for _, alias := range aliases {
+		formatAliases[alias] = format
+	}
+	if _, ok := mediaTypeFormats[encoder.MediaType()]; !ok {
+		mediaTypeFormats[encoder.MediaType()] = format
+		mediaTypes = append(mediaTypes, encoder.MediaType())
+	}
+}
+
+func init() {
+	RegisterEncoder("json", EncoderFunc{"application/json", streamJSON}, "json_", "jsonmem2")
+	RegisterEncoder("ndjson", EncoderFunc{"application/x-ndjson", streamNDJSON})
+	RegisterEncoder("csv", csvEncoder{"text/csv", "csv", CSVDialect{Delimiter: ',', Header: true, Arrays: arraysPostgres, ArraySep: ";"}}, "csv2")
+	RegisterEncoder("tsv", csvEncoder{"text/tab-separated-values", "tsv", CSVDialect{Delimiter: '\t', Header: true, Arrays: arraysPostgres, ArraySep: ";"}})
+	RegisterEncoder("arrow", EncoderFunc{"application/vnd.apache.arrow.stream", streamArrow})
+	RegisterEncoder("parquet", EncoderFunc{"application/vnd.apache.parquet", streamParquet})
+	RegisterEncoder("xlsx", EncoderFunc{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", streamXLSX})
+	RegisterEncoder("sse", EncoderFunc{"text/event-stream", streamSSE})
+
+	// Formats only chosen by name
+	RegisterEncoder("csv3", csvEncoder{"text/csv", "csv", CSVDialect{Delimiter: ',', Header: true, Null: "<nil>", Arrays: arraysJoined, ArraySep: ";"}})
+	RegisterEncoder("jsonGrouped", EncoderFunc{"application/json", streamJSONGrouped})
+	RegisterEncoder("nested", EncoderFunc{"application/json", streamJSONRows})
+	RegisterEncoder("jsonpq", EncoderFunc{"application/json", streamJSONRows})
+	RegisterEncoder("columnar", EncoderFunc{"application/json", streamColumnar})
+	RegisterEncoder("envelope", EncoderFunc{"application/json", streamEnvelope})
+}
+
+// Formats whose rows hold a JSON object each, their queries are only built by /api/gen
+var genOnlyFormats = map[string]bool{"nested": true, "jsonpq": true}
+
+// checkGenOnlyFormat refuses the formats of genOnlyFormats on the other endpoints
+func checkGenOnlyFormat(format string) error {
+	if genOnlyFormats[format] {
+		return fmt.Errorf("format %s is only supported on /api/gen", format)
+	}
+	return nil
+}
+
+// lookupFormat returns the registered format of a format name, alias or media type
+func lookupFormat(format string) (string, bool) {
+	if _, ok := encoders[format]; ok {
+		return format, true
+	}
+	if name, ok := formatAliases[format]; ok {
+		return name, true
+	}
+	name, ok := mediaTypeFormats[strings.ToLower(format)]
+	return name, ok
+}
+
+// negotiateFormat returns the format of the response: the format parameter,
+// else the best format of the Accept header, else json
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		name, ok := lookupFormat(format)
+		if !ok {
+			return "", fmt.Errorf("unsupported format: %s", format)
+		}
+		return name, nil
+	}
+	return acceptFormat(r.Header.Get("Accept")), nil
+}
+
+// mediaRange is an entry of the Accept header
+type mediaRange struct {
+	Type    string
+	Subtype string
+	Q       float64
+}
+
+// parseAccept parses the media ranges of an Accept header, malformed entries are left out
+func parseAccept(header string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		slash := strings.Index(mediaType, "/")
+		if slash <= 0 || slash == len(mediaType)-1 {
+			continue
+		}
+
+		mr := mediaRange{Type: mediaType[:slash], Subtype: mediaType[slash+1:], Q: 1}
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q >= 0 && q <= 1 {
+				mr.Q = q
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of mediaType after the most specific
+// range matching it, 0 when no range does
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, mr := range ranges {
+		s := -1
+		switch {
+		case mr.Type == typ && mr.Subtype == subtype:
+			s = 2
+		case mr.Type == typ && mr.Subtype == "*":
+			s = 1
+		case mr.Type == "*" && mr.Subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			quality, specificity = mr.Q, s
+		}
+	}
+	return quality
+}
+
+// acceptFormat returns the format with the highest quality in the Accept
+// header. Without header, or when no format is acceptable, the response is
+// not negotiated and json is written.
+func acceptFormat(header string) string {
+	if strings.TrimSpace(header) == "" {
+		return "json"
+	}
+	ranges := parseAccept(header)
+
+	candidates := append([]string{}, mediaTypes...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return acceptQuality(ranges, candidates[i]) > acceptQuality(ranges, candidates[j])
+	})
+	if len(candidates) == 0 || acceptQuality(ranges, candidates[0]) == 0 {
+		return "json"
+	}
+	return mediaTypeFormats[candidates[0]]
+}
+
+// Trailers that tell a complete streamed response from a truncated one
+const (
+	// trailerStatus is complete after the last row, error when the output failed
+	trailerStatus = "X-Stream-Status"
+	// trailerError is the message of the error that ended the output
+	trailerError = "X-Stream-Error"
+)
+
+// reportedError is an error an encoder wrote into its output, as error
+// sentinel of the JSON formats. The response still ends regularly.
+type reportedError struct {
+	error
+}
+
+func (e reportedError) Unwrap() error { return e.error }
+
+// streamErrorJSON returns the error object written by the JSON formats when the output fails
+func streamErrorJSON(err error) []byte {
+	errJSON, _ := json.Marshal(map[string]string{"message": err.Error()})
+	return errJSON
+}
+
+// errorSentinel returns the last element of a JSON array or the last line of
+// NDJSON that failed after rows were written:
+//
+//	{"__error":{"message":"..."}}
+func errorSentinel(err error) []byte {
+	return []byte(`{"__error":` + string(streamErrorJSON(err)) + `}`)
+}
+
+// statusWriter records the status code the encoder wrote
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// encodeResponse writes the rows with the encoder of requestData.Format.
+//
+// Once the header is sent a failure can't change the status code. The
+// X-Stream-Status trailer is complete after the last row and error, with the
+// message in X-Stream-Error, when the output failed. The JSON formats end
+// with an error sentinel in their output. Other formats, such as CSV, have
+// no room for one, their response is aborted so the chunked body is not
+// terminated and clients see an incomplete transfer.
+func encodeResponse(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
+	format, ok := lookupFormat(requestData.Format)
+	if !ok {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+	encoder := encoders[format]
+
+	w.Header().Set("Content-Type", encoder.MediaType())
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Trailer", trailerStatus+", "+trailerError)
+
+	sw := &statusWriter{ResponseWriter: w}
+	err := encoder.Encode(sw, rows, requestData)
+	if err == nil {
+		if sw.status < 300 {
+			w.Header().Set(trailerStatus, "complete")
+		}
+		return
+	}
+
+	log.Printf("query %s: %s stream failed: %v", requestData.QueryID, format, err)
+	w.Header().Set(trailerStatus, "error")
+	w.Header().Set(trailerError, strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, err.Error()))
+	if !errors.As(err, &reportedError{}) {
+		sw.Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// truncated reports whether a result of count rows reached the limit of the
+// request, so there may be more rows. A last page of exactly limit rows is
+// truncated too, the page after it is empty.
+func (requestData *RequestData) truncated(count int) bool {
+	limit, err := strconv.Atoi(requestData.Limit)
+	return err == nil && limit > 0 && count >= limit
+}
+
+// rowScanner is the row scanning core of the encoders. Every call of Next
+// scans a row into Values.
+type rowScanner struct {
+	rows    *sql.Rows
+	Columns []string
+	Types   []*sql.ColumnType
+	Values  []interface{}
+	// Indexes of the columns to output, the columns added by a grouped query are left out
+	Visible []int
+
+	pointers  []interface{}
+	namesJSON [][]byte
+	object    []byte
+	err       error
+}
+
+func newRowScanner(rows *sql.Rows) (*rowScanner, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &rowScanner{
+		rows:      rows,
+		Columns:   cols,
+		Types:     columnTypes,
+		Values:    make([]interface{}, len(cols)),
+		pointers:  make([]interface{}, len(cols)),
+		namesJSON: make([][]byte, len(cols)),
+	}
+	for i, col := range cols {
+		s.pointers[i] = &s.Values[i]
+		s.namesJSON[i], _ = json.Marshal(col)
+		if !isGroupColumn(col) {
+			s.Visible = append(s.Visible, i)
+		}
+	}
+	return s, nil
+}
+
+// Next scans the next row, it returns false after the last row or on an error
+func (s *rowScanner) Next() bool {
+	if s.err != nil || !s.rows.Next() {
+		return false
+	}
+	if err := s.rows.Scan(s.pointers...); err != nil {
+		s.err = err
+		return false
+	}
+	return true
+}
+
+// Err returns the error that ended Next, if any
+func (s *rowScanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.rows.Err()
+}
+
+// VisibleColumns returns the names of the columns to output
+func (s *rowScanner) VisibleColumns() []string {
+	names := make([]string, len(s.Visible))
+	for n, i := range s.Visible {
+		names[n] = s.Columns[i]
+	}
+	return names
+}
+
+// VisibleTypes returns the types of the columns to output
+func (s *rowScanner) VisibleTypes() []*sql.ColumnType {
+	types := make([]*sql.ColumnType, len(s.Visible))
+	for n, i := range s.Visible {
+		types[n] = s.Types[i]
+	}
+	return types
+}
+
+// JSONDecoders returns the decoders of the columns after their database type
+func (s *rowScanner) JSONDecoders(requestData *RequestData) []jsonDecoder {
+	return jsonDecoders(s.Types, requestData.NumericString)
+}
+
+// JSONObject encodes the scanned row as JSON object in column order. The
+// result is only valid until the next call.
+func (s *rowScanner) JSONObject(decoders []jsonDecoder) []byte {
+	s.object = append(s.object[:0], '{')
+	for n, i := range s.Visible {
+		if n > 0 {
+			s.object = append(s.object, ',')
+		}
+		valueJSON, err := json.Marshal(decoders[i](s.Values[i]))
+		if err != nil {
+			valueJSON = []byte("null")
+		}
+		s.object = append(s.object, s.namesJSON[i]...)
+		s.object = append(s.object, ':')
+		s.object = append(s.object, valueJSON...)
+	}
+	s.object = append(s.object, '}')
+	return s.object
+}
+
+// JSONArray encodes the scanned row as JSON array of its values in column
+// order. The result is only valid until the next call.
+func (s *rowScanner) JSONArray(decoders []jsonDecoder) []byte {
+	s.object = append(s.object[:0], '[')
+	for n, i := range s.Visible {
+		if n > 0 {
+			s.object = append(s.object, ',')
+		}
+		valueJSON, err := json.Marshal(decoders[i](s.Values[i]))
+		if err != nil {
+			valueJSON = []byte("null")
+		}
+		s.object = append(s.object, valueJSON...)
+	}
+	s.object = append(s.object, ']')
+	return s.object
+}
+
+// Rows and time after which the buffered output of a streamed format is flushed to the client
+const (
+	streamFlushRows     = 1000
+	streamFlushInterval = 500 * time.Millisecond
+)
+
+// streamWriter buffers the output of a streamed format and flushes it
+// regularly, so rows reach the client while the query still runs
+type streamWriter struct {
+	*bufio.Writer
+	w         http.ResponseWriter
+	pending   int
+	lastFlush time.Time
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{Writer: bufio.NewWriter(w), w: w, lastFlush: time.Now()}
+}
+
+// Row counts a written row and flushes when enough rows or time passed
+func (sw *streamWriter) Row() error {
+	sw.pending++
+	if sw.pending < streamFlushRows && time.Since(sw.lastFlush) < streamFlushInterval {
+		return nil
+	}
+	return sw.Flush()
+}
+
+// Flush sends the buffered output to the client
+func (sw *streamWriter) Flush() error {
+	if err := sw.Writer.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	sw.pending = 0
+	sw.lastFlush = time.Now()
+	return nil
+}
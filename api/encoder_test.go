@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	testCases := []struct {
+		url      string
+		accept   string
+		expected string
+		err      bool
+	}{
+		{"/api/gen/?dn=domain.arp", "", "json", false},
+		{"/api/gen/?dn=domain.arp&format=csv", "application/json", "csv", false},
+		{"/api/gen/?dn=domain.arp&format=json_", "", "json", false},
+		{"/api/gen/?dn=domain.arp&format=csv2", "", "csv", false},
+		{"/api/gen/?dn=domain.arp&format=csv3", "", "csv3", false},
+		{"/api/gen/?dn=domain.arp&format=text/csv", "", "csv", false},
+		{"/api/gen/?dn=domain.arp&format=application/vnd.apache.parquet", "", "parquet", false},
+		{"/api/gen/?dn=domain.arp&format=yaml", "", "", true},
+		{"/api/gen/?dn=domain.arp", "text/csv", "csv", false},
+		{"/api/gen/?dn=domain.arp", "application/x-ndjson;q=0.9, text/csv;q=0.5", "ndjson", false},
+		{"/api/gen/?dn=domain.arp", "application/*;q=0.2, text/csv;q=0.1", "json", false},
+		{"/api/gen/?dn=domain.arp", "text/*, application/json;q=0.5", "csv", false},
+		{"/api/gen/?dn=domain.arp", "text/html,application/xhtml+xml,*/*;q=0.8", "json", false},
+		{"/api/gen/?dn=domain.arp", "*/*, application/json;q=0", "ndjson", false},
+		{"/api/gen/?dn=domain.arp", "image/png", "json", false},
+		{"/api/gen/?dn=domain.arp", "text/event-stream", "sse", false},
+	}
+
+	for i, tc := range testCases {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		format, err := negotiateFormat(r)
+		if (err != nil) != tc.err {
+			t.Errorf("test number %d: unexpected error %v", i, err)
+			continue
+		}
+		if format != tc.expected {
+			t.Errorf("test number %d: expected %s, got %s", i, tc.expected, format)
+		}
+	}
+}
+
+func TestEncodeResponseHeaders(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", groupRowColumn, groupLevelColumn + "1"},
+		Types:   []string{"TEXT", "INT8", "INT8"},
+		Rows:    [][]driver.Value{{"eth0", int64(1), int64(1)}},
+	}
+
+	testCases := []struct {
+		format      string
+		contentType string
+		body        string
+	}{
+		{"json", "application/json", `[{"device":"eth0"}]`},
+		{"jsonmem2", "application/json", `[{"device":"eth0"}]`},
+		{"csv", "text/csv", "device\neth0\n"},
+		{"ndjson", "application/x-ndjson", "{\"device\":\"eth0\"}\n"},
+	}
+
+	for i, tc := range testCases {
+		w := httptest.NewRecorder()
+		encodeResponse(w, queryFake(t, result), &RequestData{Format: tc.format})
+		if contentType := w.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("test number %d: expected content type %s, got %s", i, tc.contentType, contentType)
+		}
+		if vary := w.Header().Values("Vary"); len(vary) == 0 || vary[0] != "Accept" {
+			t.Errorf("test number %d: expected Vary: Accept, got %v", i, vary)
+		}
+		if body := w.Body.String(); body != tc.body {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.body, body)
+		}
+	}
+}
+
+func TestEncodeResponseStreamError(t *testing.T) {
+	failing := fakeResult{
+		Columns: []string{"device", groupRowColumn, groupLevelColumn + "1"},
+		Types:   []string{"TEXT", "INT8", "INT8"},
+		Rows:    [][]driver.Value{{"eth0", int64(1), int64(1)}},
+		Err:     errors.New("canceling statement\ndue to timeout"),
+	}
+	complete := failing
+	complete.Err = nil
+
+	testCases := []struct {
+		format  string
+		groupBy []string
+		result  fakeResult
+		body    string
+		status  string
+		aborted bool
+	}{
+		{"json", nil, complete, `[{"device":"eth0"}]`, "complete", false},
+		{"json", nil, failing, `[{"device":"eth0"},{"__error":{"message":"canceling statement\ndue to timeout"}}]`, "error", false},
+		{"nested", nil, fakeResult{Columns: []string{"row"}, Err: errors.New("timeout")}, `[{"__error":{"message":"timeout"}}]`, "error", false},
+		{"ndjson", nil, failing, "{\"device\":\"eth0\"}\n{\"__error\":{\"message\":\"canceling statement\\ndue to timeout\"}}\n", "error", false},
+		{"jsonGrouped", []string{"device"}, failing, `{"eth0":{"rows":[{"device":"eth0"}],"count":1},"__error":{"message":"canceling statement\ndue to timeout"}}`, "error", false},
+		{"csv", nil, complete, "device\neth0\n", "complete", false},
+		{"csv", nil, failing, "device\neth0\n", "error", true},
+		{"arrow", nil, failing, "", "error", true},
+	}
+
+	for i, tc := range testCases {
+		w := httptest.NewRecorder()
+		aborted := func() (aborted bool) {
+			defer func() {
+				if p := recover(); p != nil {
+					if p != http.ErrAbortHandler {
+						panic(p)
+					}
+					aborted = true
+				}
+			}()
+			encodeResponse(w, queryFake(t, tc.result), &RequestData{Format: tc.format, GroupBy: tc.groupBy})
+			return false
+		}()
+
+		if aborted != tc.aborted {
+			t.Errorf("test number %d: expected aborted %v, got %v", i, tc.aborted, aborted)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.body, w.Body.String())
+		}
+		trailer := w.Result().Trailer
+		if status := trailer.Get(trailerStatus); status != tc.status {
+			t.Errorf("test number %d: expected %s %s, got %q", i, trailerStatus, tc.status, status)
+		}
+		message := trailer.Get(trailerError)
+		if (tc.status == "error") != (message != "") || strings.ContainsAny(message, "\r\n") {
+			t.Errorf("test number %d: unexpected %s %q", i, trailerError, message)
+		}
+	}
+
+	for _, format := range []string{"columnar", "envelope"} {
+		w := httptest.NewRecorder()
+		encodeResponse(w, queryFake(t, failing), &RequestData{Format: format, Limit: "1"})
+		if !strings.Contains(w.Body.String(), `"error":{"message":"canceling statement\ndue to timeout"}`) {
+			t.Errorf("%s: expected the error in the metadata, got %s", format, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), `"next_cursor":"`) {
+			t.Errorf("%s: expected no next_cursor after an error, got %s", format, w.Body.String())
+		}
+		if status := w.Result().Trailer.Get(trailerStatus); status != "error" {
+			t.Errorf("%s: expected %s error, got %q", format, trailerStatus, status)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// envelopeCursor is the position a next_cursor continues the result at
+type envelopeCursor struct {
+	Offset int `json:"offset"`
+}
+
+// parseCursor parses cursor=<next_cursor of a previous page> into the offset
+// of its first row, 0 without cursor
+func parseCursor(params url.Values) (int, error) {
+	value := params.Get("cursor")
+	if value == "" {
+		return 0, nil
+	}
+	cursor := envelopeCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil || cursor.Offset < 0 {
+		return 0, fmt.Errorf("invalid cursor value: %s", value)
+	}
+	return cursor.Offset, nil
+}
+
+// encodeCursor returns the cursor of the page starting at offset
+func encodeCursor(offset int) string {
+	data, _ := json.Marshal(envelopeCursor{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// newQueryID returns a random ID, so an envelope can be matched with the server log
+func newQueryID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// envelopeMeta is written after the data of the envelope format
+type envelopeMeta struct {
+	Rows            int      `json:"rows"`
+	ElapsedDBMS     float64  `json:"elapsed_db_ms"`
+	ElapsedEncodeMS float64  `json:"elapsed_encode_ms"`
+	Truncated       bool     `json:"truncated"`
+	NextCursor      *string  `json:"next_cursor"`
+	SQL             string   `json:"sql,omitempty"`
+	Warnings        []string `json:"warnings"`
+	// Error that ended the data, it is incomplete
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// milliseconds returns d in milliseconds with microsecond precision
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// streamEnvelope writes the rows as the data array of the json format,
+// wrapped with the query ID and followed by metadata about the execution:
+//
+//	{"query_id":..,"data":[{..},..],"meta":{"rows":..,"truncated":..,"next_cursor":..,..}}
+//
+// The time spent fetching rows from the database counts as database time,
+// the rest of the writing as encode time. A failing query sets error in the
+// metadata.
+func streamEnvelope(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	start := time.Now()
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	decoders := s.JSONDecoders(requestData)
+
+	out := newStreamWriter(w)
+	defer out.Flush()
+	w.WriteHeader(http.StatusOK)
+
+	queryIDJSON, _ := json.Marshal(requestData.QueryID)
+	out.WriteString(`{"query_id":`)
+	out.Write(queryIDJSON)
+	out.WriteString(`,"data":[`)
+
+	meta := envelopeMeta{SQL: requestData.SQL, Warnings: append([]string{}, requestData.Warnings...)}
+	fetch := requestData.QueryTime
+	for {
+		fetchStart := time.Now()
+		ok := s.Next()
+		fetch += time.Since(fetchStart)
+		if !ok {
+			break
+		}
+
+		if meta.Rows > 0 {
+			out.WriteString(",")
+		}
+		if _, err := out.Write(s.JSONObject(decoders)); err != nil {
+			return err
+		}
+		meta.Rows++
+		if err := out.Row(); err != nil {
+			return err
+		}
+	}
+	err = s.Err()
+	if err != nil {
+		meta.Error = streamErrorJSON(err)
+		err = reportedError{err}
+	}
+
+	meta.Truncated = requestData.truncated(meta.Rows)
+	if meta.Truncated && meta.Error == nil {
+		cursor := encodeCursor(requestData.Offset + meta.Rows)
+		meta.NextCursor = &cursor
+	}
+	meta.ElapsedDBMS = milliseconds(fetch)
+	meta.ElapsedEncodeMS = milliseconds(time.Since(start) - (fetch - requestData.QueryTime))
+
+	metaJSON, _ := json.Marshal(meta)
+	out.WriteString(`],"meta":`)
+	out.Write(metaJSON)
+	out.WriteString("}")
+	return err
+}
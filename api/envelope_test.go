@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCursor(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected int
+		Err      bool
+	}{
+		{Input: "", Expected: 0},
+		{Input: "cursor=" + encodeCursor(100), Expected: 100},
+		{Input: "cursor=" + encodeCursor(-1), Err: true},
+		{Input: "cursor=100", Err: true},
+		{Input: "cursor=e30", Expected: 0},
+	}
+
+	for testNum, testCase := range testCases {
+		params, _ := url.ParseQuery(testCase.Input)
+		offset, err := parseCursor(params)
+		if (err != nil) != testCase.Err {
+			t.Errorf("test number %d: unexpected error %v", testNum+1, err)
+			continue
+		}
+		if offset != testCase.Expected {
+			t.Errorf("test number %d: expected offset %d, got %d", testNum+1, testCase.Expected, offset)
+		}
+	}
+}
+
+func TestBuildQueryCursor(t *testing.T) {
+	params, _ := url.ParseQuery("dn=domain.arp&field=domain.arp.device&orderby=asc:domain.arp.device&limit=10&cursor=" + encodeCursor(30))
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := BuildQuery(qp)
+	if !strings.HasSuffix(strings.TrimSpace(query), "LIMIT 10 OFFSET 30") {
+		t.Errorf("expected LIMIT 10 OFFSET 30, got %s", query)
+	}
+
+	params, _ = url.ParseQuery("dn=domain.arp&sample=rows:10&cursor=" + encodeCursor(30))
+	if _, err := ParseQueryParams(params); err == nil {
+		t.Errorf("expected an error for a cursor on a rows sample")
+	}
+}
+
+func TestStreamEnvelope(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "flags"},
+		Types:   []string{"TEXT", "INT4"},
+		Rows: [][]driver.Value{
+			{[]byte("eth0"), []byte("2")},
+			{"eth1", nil},
+		},
+	}
+
+	testCases := []struct {
+		Limit      string
+		Offset     int
+		Truncated  bool
+		NextCursor string
+	}{
+		{Limit: "", Truncated: false},
+		{Limit: "5", Truncated: false},
+		{Limit: "2", Truncated: true, NextCursor: encodeCursor(2)},
+		{Limit: "2", Offset: 4, Truncated: true, NextCursor: encodeCursor(6)},
+	}
+
+	for testNum, testCase := range testCases {
+		requestData := &RequestData{
+			Format:   "envelope",
+			Limit:    testCase.Limit,
+			Offset:   testCase.Offset,
+			QueryID:  "0123456789abcdef",
+			SQL:      `SELECT * FROM "domain.arp"`,
+			Warnings: []string{"a warning"},
+		}
+		w := httptest.NewRecorder()
+		encodeResponse(w, queryFake(t, result), requestData)
+
+		var got struct {
+			QueryID string `json:"query_id"`
+			Data    []map[string]interface{}
+			Meta    envelopeMeta
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("test number %d: invalid JSON %q: %v", testNum+1, w.Body.String(), err)
+		}
+
+		if got.QueryID != "0123456789abcdef" {
+			t.Errorf("test number %d: unexpected query_id %s", testNum+1, got.QueryID)
+		}
+		data := []map[string]interface{}{
+			{"device": "eth0", "flags": float64(2)},
+			{"device": "eth1", "flags": nil},
+		}
+		if !reflect.DeepEqual(got.Data, data) {
+			t.Errorf("test number %d: expected data %v, got %v", testNum+1, data, got.Data)
+		}
+		if got.Meta.Rows != 2 || got.Meta.Truncated != testCase.Truncated || got.Meta.SQL != requestData.SQL {
+			t.Errorf("test number %d: unexpected meta %+v", testNum+1, got.Meta)
+		}
+		nextCursor := ""
+		if got.Meta.NextCursor != nil {
+			nextCursor = *got.Meta.NextCursor
+		}
+		if nextCursor != testCase.NextCursor {
+			t.Errorf("test number %d: expected next_cursor %q, got %q", testNum+1, testCase.NextCursor, nextCursor)
+		}
+		if !reflect.DeepEqual(got.Meta.Warnings, []string{"a warning"}) {
+			t.Errorf("test number %d: unexpected warnings %v", testNum+1, got.Meta.Warnings)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeResult is the result a query returns from the fake driver
+type fakeResult struct {
+	Columns []string
+	Types   []string
+	Rows    [][]driver.Value
+	// Err is returned after the rows, as a query failing mid-stream
+	Err error
+}
+
+var (
+	fakeResultsMutex sync.Mutex
+	fakeResults      = map[string]fakeResult{}
+	fakeDB           *sql.DB
+)
+
+type fakeDriver struct{}
+type fakeConn struct{}
+type fakeStmt struct{ query string }
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{query: query}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("not supported") }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	fakeResultsMutex.Lock()
+	defer fakeResultsMutex.Unlock()
+	result, ok := fakeResults[s.query]
+	if !ok {
+		return nil, fmt.Errorf("unknown query: %s", s.query)
+	}
+	return &fakeRows{result: result}, nil
+}
+
+func (r *fakeRows) Columns() []string { return r.result.Columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		if r.result.Err != nil {
+			return r.result.Err
+		}
+		return io.EOF
+	}
+	copy(dest, r.result.Rows[r.next])
+	r.next++
+	return nil
+}
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.result.Types) {
+		return r.result.Types[index]
+	}
+	return "TEXT"
+}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+	fakeDB, _ = sql.Open("fake", "")
+}
+
+// queryFake returns the rows of result as *sql.Rows
+func queryFake(t *testing.T, result fakeResult) *sql.Rows {
+	t.Helper()
+	fakeResultsMutex.Lock()
+	query := fmt.Sprintf("fake %d", len(fakeResults))
+	fakeResults[query] = result
+	fakeResultsMutex.Unlock()
+
+	rows, err := fakeDB.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Column numbering the rows of a grouped query, so rows keep the query order within a group
+const groupRowColumn = "__group_row"
+
+// Prefix of the columns with the sort position of the group of every level,
+// groups end when the database sees a different key, not when the text changes
+const groupLevelColumn = "__group_level_"
+
+// parseGroupBy parses groupby=a,b,c into the group keys, outermost first.
+// groupby2 is still accepted as second key.
+func parseGroupBy(params url.Values) []string {
+	keys := []string{}
+	for _, value := range append(params["groupby"], params["groupby2"]...) {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// ConstructGroupQuery orders the rows of the query on the group keys, so
+// groups can be written as soon as the key changes. The group of every level
+// is numbered by its sort position on the keys up to that level.
+func ConstructGroupQuery(query string, keys []string) string {
+	order := []string{}
+	levels := []string{}
+	for i, key := range keys {
+		order = append(order, pq.QuoteIdentifier(key))
+		levels = append(levels, fmt.Sprintf(", dense_rank() OVER (ORDER BY %s) AS %s%d", strings.Join(order, ", "), groupLevelColumn, i+1))
+	}
+	order = append(order, groupRowColumn)
+
+	return fmt.Sprintf("SELECT * FROM (SELECT *, row_number() OVER () AS %s%s FROM (%s\n) AS grouped_rows) AS grouped_query ORDER BY %s",
+		groupRowColumn, strings.Join(levels, ""), trimQuery(query), strings.Join(order, ", "))
+}
+
+// isGroupColumn reports whether a column was added by ConstructGroupQuery
+func isGroupColumn(col string) bool {
+	return col == groupRowColumn || strings.HasPrefix(col, groupLevelColumn)
+}
+
+// groupQuery returns the query ordered for the grouped JSON format and for
+// xlsx with groupby, other formats are unchanged
+func (requestData *RequestData) groupQuery(query string) string {
+	switch {
+	case requestData.Format == "jsonGrouped":
+	case requestData.Format == "xlsx" && len(requestData.GroupBy) > 0:
+	default:
+		return query
+	}
+	return ConstructGroupQuery(query, requestData.GroupBy)
+}
+
+// groupLevelIndexes returns the index of the group position column of every level
+func groupLevelIndexes(cols []string, depth int) ([]int, error) {
+	indexes := make([]int, depth)
+	for i := range indexes {
+		indexes[i] = -1
+		for j, col := range cols {
+			if col == fmt.Sprintf("%s%d", groupLevelColumn, i+1) {
+				indexes[i] = j
+			}
+		}
+		if indexes[i] == -1 {
+			return nil, fmt.Errorf("the query is not grouped on level %d", i+1)
+		}
+	}
+	return indexes, nil
+}
+
+// groupPosition returns the group position as scanned from lib/pq
+func groupPosition(v interface{}) int64 {
+	position, _ := v.(int64)
+	return position
+}
+
+// groupKeyIndexes returns the index of every group key among the columns
+func groupKeyIndexes(cols []string, keys []string) ([]int, error) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = -1
+		for j, col := range cols {
+			if col == key {
+				indexes[i] = j
+			}
+		}
+		if indexes[i] == -1 {
+			return nil, fmt.Errorf("unknown groupby column: %s", key)
+		}
+	}
+	return indexes, nil
+}
+
+func groupKey(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case []byte:
+		return string(value)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// groupWriter writes rows ordered on the group keys as nested JSON objects
+//
+//	{"<a>": {"groups": {"<b>": {"rows": [...], "count": 2}}, "count": 2}}
+//
+// Only the open groups and the names of their subgroups are kept, so memory
+// does not grow with the rows of the result.
+type groupWriter struct {
+	w       io.Writer
+	depth   int
+	started bool
+	// Position, row count and number of written subgroups of the open group per level
+	positions []int64
+	counts    []int
+	groups    []int
+	// Member names written per level in the open parent group. Different
+	// keys with the same text, such as NULL and 'null', get a suffix.
+	names []map[string]bool
+}
+
+func newGroupWriter(w io.Writer, depth int) *groupWriter {
+	g := &groupWriter{
+		w:         w,
+		depth:     depth,
+		positions: make([]int64, depth),
+		counts:    make([]int, depth),
+		groups:    make([]int, depth+1),
+		names:     make([]map[string]bool, depth+1),
+	}
+	g.names[0] = map[string]bool{}
+	return g
+}
+
+// close ends the open groups from the innermost level up to level
+func (g *groupWriter) close(level int) {
+	for j := g.depth - 1; j >= level; j-- {
+		if j == g.depth-1 {
+			fmt.Fprintf(g.w, `],"count":%d}`, g.counts[j])
+		} else {
+			fmt.Fprintf(g.w, `},"count":%d}`, g.counts[j])
+		}
+	}
+}
+
+func (g *groupWriter) begin() {
+	io.WriteString(g.w, "{")
+}
+
+// row writes an encoded row under its group keys, a group ends when the
+// position of the group changes
+func (g *groupWriter) row(positions []int64, keys []string, row []byte) {
+	level := 0
+	if g.started {
+		for level < g.depth && positions[level] == g.positions[level] {
+			level++
+		}
+		g.close(level)
+	}
+	g.started = true
+
+	for j := level; j < g.depth; j++ {
+		if g.groups[j] > 0 {
+			io.WriteString(g.w, ",")
+		}
+		g.groups[j]++
+		g.groups[j+1] = 0
+
+		name := keys[j]
+		for n := 2; g.names[j][name]; n++ {
+			name = fmt.Sprintf("%s (%d)", keys[j], n)
+		}
+		g.names[j][name] = true
+		g.names[j+1] = map[string]bool{}
+
+		keyJSON, _ := json.Marshal(name)
+		g.w.Write(keyJSON)
+		if j == g.depth-1 {
+			io.WriteString(g.w, `:{"rows":[`)
+		} else {
+			io.WriteString(g.w, `:{"groups":{`)
+		}
+		g.positions[j] = positions[j]
+		g.counts[j] = 0
+	}
+
+	if level == g.depth {
+		io.WriteString(g.w, ",")
+	}
+	g.w.Write(row)
+	for j := range g.counts {
+		g.counts[j]++
+	}
+}
+
+func (g *groupWriter) end() {
+	if g.started {
+		g.close(0)
+	}
+	io.WriteString(g.w, "}")
+}
+
+// Member of the error of a failing query, next to the groups
+const groupErrorMember = "__error"
+
+// fail ends the open groups and the output with the error of a failing
+// query, as "__error" member after the groups. An error object only has a
+// message, groups always have a count. When a group is called __error
+// already the member is left out, the X-Stream-Status trailer still reports
+// the error.
+func (g *groupWriter) fail(err error) {
+	if g.started {
+		g.close(0)
+	}
+	if !g.names[0][groupErrorMember] {
+		if g.started {
+			io.WriteString(g.w, ",")
+		}
+		keyJSON, _ := json.Marshal(groupErrorMember)
+		g.w.Write(keyJSON)
+		io.WriteString(g.w, ":")
+		g.w.Write(streamErrorJSON(err))
+	}
+	io.WriteString(g.w, "}")
+}
+
+// streamJSONGrouped writes the rows of a query built by ConstructGroupQuery
+// grouped on requestData.GroupBy, to any depth.
+func streamJSONGrouped(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	keyIndexes, err := groupKeyIndexes(s.Columns, requestData.GroupBy)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil
+	}
+	levelIndexes, err := groupLevelIndexes(s.Columns, len(requestData.GroupBy))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	decoders := s.JSONDecoders(requestData)
+
+	w.WriteHeader(http.StatusOK)
+
+	groups := newGroupWriter(w, len(requestData.GroupBy))
+	groups.begin()
+
+	keys := make([]string, len(keyIndexes))
+	positions := make([]int64, len(levelIndexes))
+	for s.Next() {
+		for i, index := range keyIndexes {
+			keys[i] = groupKey(s.Values[index])
+			positions[i] = groupPosition(s.Values[levelIndexes[i]])
+		}
+		groups.row(positions, keys, s.JSONObject(decoders))
+	}
+	if err := s.Err(); err != nil {
+		groups.fail(err)
+		return reportedError{err}
+	}
+	groups.end()
+	return nil
+}
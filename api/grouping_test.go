@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected []string
+	}{
+		{Input: "", Expected: []string{}},
+		{Input: "groupby=node", Expected: []string{"node"}},
+		{Input: "groupby=a,b, c", Expected: []string{"a", "b", "c"}},
+		{Input: "groupby=node&groupby2=field", Expected: []string{"node", "field"}},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.Input)
+		if keys := parseGroupBy(params); !reflect.DeepEqual(keys, tc.Expected) {
+			t.Errorf("test number %d: expected %v, got %v", i+1, tc.Expected, keys)
+		}
+	}
+}
+
+func TestConstructGroupQuery(t *testing.T) {
+	query := ConstructGroupQuery(`SELECT * FROM "domain.arp" AS domain_arp ORDER BY domain_arp.ip_address; `, []string{"device", "hw_type"})
+	expected := `SELECT * FROM (SELECT *, row_number() OVER () AS __group_row, dense_rank() OVER (ORDER BY "device") AS __group_level_1, dense_rank() OVER (ORDER BY "device", "hw_type") AS __group_level_2 FROM (SELECT * FROM "domain.arp" AS domain_arp ORDER BY domain_arp.ip_address
+) AS grouped_rows) AS grouped_query ORDER BY "device", "hw_type", __group_row`
+	if query != expected {
+		t.Errorf("expected %s, got %s", expected, query)
+	}
+	if _, err := pg_query.Parse(query); err != nil {
+		t.Errorf("query does not parse: %v", err)
+	}
+}
+
+func TestGroupWriter(t *testing.T) {
+	type row struct {
+		Positions []int64
+		Keys      []string
+		Row       string
+	}
+
+	testCases := []struct {
+		Depth    int
+		Rows     []row
+		Expected string
+	}{
+		{Depth: 1, Rows: nil, Expected: `{}`},
+		{
+			Depth:    1,
+			Rows:     []row{{[]int64{1}, []string{"a"}, `{"x":1}`}, {[]int64{1}, []string{"a"}, `{"x":2}`}, {[]int64{2}, []string{"b"}, `{"x":3}`}},
+			Expected: `{"a":{"rows":[{"x":1},{"x":2}],"count":2},"b":{"rows":[{"x":3}],"count":1}}`,
+		},
+		{
+			// numeric 1.0 and 1.00 are the same group, NULL and 'null' are not
+			Depth: 1,
+			Rows: []row{
+				{[]int64{1}, []string{"1.0"}, `1`},
+				{[]int64{1}, []string{"1.00"}, `2`},
+				{[]int64{2}, []string{"null"}, `3`},
+				{[]int64{3}, []string{"null"}, `4`},
+			},
+			Expected: `{"1.0":{"rows":[1,2],"count":2},"null":{"rows":[3],"count":1},"null (2)":{"rows":[4],"count":1}}`,
+		},
+		{
+			Depth: 3,
+			Rows: []row{
+				{[]int64{1, 1, 1}, []string{"a", "1", "x"}, `1`},
+				{[]int64{1, 1, 2}, []string{"a", "1", "y"}, `2`},
+				{[]int64{1, 2, 3}, []string{"a", "2", "y"}, `3`},
+				{[]int64{2, 3, 4}, []string{"b", "2", "y"}, `4`},
+				{[]int64{2, 3, 4}, []string{"b", "2", "y"}, `5`},
+			},
+			Expected: `{"a":{"groups":{"1":{"groups":{"x":{"rows":[1],"count":1},"y":{"rows":[2],"count":1}},"count":2},` +
+				`"2":{"groups":{"y":{"rows":[3],"count":1}},"count":1}},"count":3},` +
+				`"b":{"groups":{"2":{"groups":{"y":{"rows":[4,5],"count":2}},"count":2}},"count":2}}`,
+		},
+	}
+
+	for i, tc := range testCases {
+		var buffer bytes.Buffer
+		groups := newGroupWriter(&buffer, tc.Depth)
+		groups.begin()
+		for _, r := range tc.Rows {
+			groups.row(r.Positions, r.Keys, []byte(r.Row))
+		}
+		groups.end()
+
+		if buffer.String() != tc.Expected {
+			t.Errorf("test number %d: expected %s, got %s", i+1, tc.Expected, buffer.String())
+		}
+		if !json.Valid(buffer.Bytes()) {
+			t.Errorf("test number %d: invalid JSON %s", i+1, buffer.String())
+		}
+	}
+}
+
+func TestGroupWriterFail(t *testing.T) {
+	testCases := []struct {
+		Keys     []string
+		Expected string
+	}{
+		{Keys: nil, Expected: `{"__error":{"message":"timeout"}}`},
+		{Keys: []string{"a"}, Expected: `{"a":{"rows":[1],"count":1},"__error":{"message":"timeout"}}`},
+		{Keys: []string{"__error"}, Expected: `{"__error":{"rows":[1],"count":1}}`},
+	}
+
+	for i, tc := range testCases {
+		var buffer bytes.Buffer
+		groups := newGroupWriter(&buffer, 1)
+		groups.begin()
+		for i, key := range tc.Keys {
+			groups.row([]int64{int64(i + 1)}, []string{key}, []byte("1"))
+		}
+		groups.fail(errors.New("timeout"))
+
+		if buffer.String() != tc.Expected {
+			t.Errorf("test number %d: expected %s, got %s", i+1, tc.Expected, buffer.String())
+		}
+	}
+}
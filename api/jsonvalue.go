@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// jsonDecoder converts a value as scanned from lib/pq into a value that
+// json.Marshal encodes as its JSON counterpart
+type jsonDecoder func(v interface{}) interface{}
+
+// parseNumericString parses numeric=<number|string>. Numerics are written as
+// JSON numbers by default, as strings they keep their precision in clients
+// that parse numbers as float.
+func parseNumericString(params url.Values) (bool, error) {
+	switch value := params.Get("numeric"); value {
+	case "", "number":
+		return false, nil
+	case "string":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid numeric value: %s. Only number or string is allowed", value)
+	}
+}
+
+// jsonDecoders returns the decoder of every column, driven by its database type
+func jsonDecoders(columnTypes []*sql.ColumnType, numericString bool) []jsonDecoder {
+	decoders := make([]jsonDecoder, len(columnTypes))
+	for i, ct := range columnTypes {
+		decoders[i] = newJSONDecoder(ct.DatabaseTypeName(), numericString)
+	}
+	return decoders
+}
+
+func newJSONDecoder(dbType string, numericString bool) jsonDecoder {
+	dbType = strings.ToUpper(dbType)
+	return func(v interface{}) interface{} {
+		switch value := v.(type) {
+		case nil:
+			return nil
+		case []byte:
+			if dbType == "BYTEA" {
+				return `\x` + hex.EncodeToString(value)
+			}
+			return jsonText(dbType, string(value), numericString)
+		case string:
+			return jsonText(dbType, value, numericString)
+		case time.Time:
+			return jsonTime(dbType, value)
+		case float64:
+			// JSON has no NaN or infinity
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return strconv.FormatFloat(value, 'g', -1, 64)
+			}
+		}
+		return v
+	}
+}
+
+func jsonTime(dbType string, t time.Time) string {
+	switch dbType {
+	case "DATE":
+		return t.Format("2006-01-02")
+	case "TIME":
+		return t.Format("15:04:05.999999")
+	case "TIMETZ":
+		return t.Format("15:04:05.999999Z07:00")
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// jsonText converts the text output of Postgres for a value of dbType. Values
+// that don't parse, such as 'infinity' timestamps, are kept as text.
+func jsonText(dbType string, s string, numericString bool) interface{} {
+	if strings.HasPrefix(dbType, "_") {
+		return jsonArray(dbType[1:], s, numericString)
+	}
+
+	switch dbType {
+	case "INT2", "INT4", "INT8", "OID":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case "FLOAT4", "FLOAT8":
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case "NUMERIC":
+		if !numericString && jsonNumber.MatchString(s) {
+			return json.Number(s)
+		}
+	case "BOOL":
+		if s == "t" || s == "f" {
+			return s == "t"
+		}
+	case "JSON", "JSONB":
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+	case "INTERVAL":
+		if iso, ok := isoInterval(s); ok {
+			return iso
+		}
+	case "UUID", "MACADDR", "MACADDR8":
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// jsonArray decodes a one dimensional array into a JSON array of its
+// elements, other arrays are kept as text
+func jsonArray(elementType string, s string, numericString bool) interface{} {
+	elements := []sql.NullString{}
+	if err := (pq.GenericArray{A: &elements}).Scan([]byte(s)); err != nil {
+		return s
+	}
+
+	values := make([]interface{}, len(elements))
+	for i, element := range elements {
+		if element.Valid {
+			values[i] = jsonText(elementType, element.String, numericString)
+		}
+	}
+	return values
+}
+
+// jsonNumber matches the numerics that are valid JSON numbers, NaN and infinity are not
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// isoInterval converts an interval in the postgres output style, e.g.
+// "1 year 2 mons -3 days 04:05:06.5", into an ISO 8601 duration such as
+// "P1Y2M-3DT4H5M6.5S".
+func isoInterval(s string) (string, bool) {
+	if strings.HasPrefix(s, "P") {
+		return s, true
+	}
+
+	date := ""
+	clock := ""
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			if i != len(fields)-1 {
+				return "", false
+			}
+			var ok bool
+			if clock, ok = isoClock(fields[i]); !ok {
+				return "", false
+			}
+			continue
+		}
+
+		if i+1 == len(fields) {
+			return "", false
+		}
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return "", false
+		}
+		unit := ""
+		switch strings.TrimSuffix(fields[i+1], "s") {
+		case "year":
+			unit = "Y"
+		case "mon":
+			unit = "M"
+		case "day":
+			unit = "D"
+		default:
+			return "", false
+		}
+		date += strconv.Itoa(n) + unit
+		i++
+	}
+
+	if date == "" && clock == "" {
+		return "PT0S", true
+	}
+	if clock != "" {
+		clock = "T" + clock
+	}
+	return "P" + date + clock, true
+}
+
+// isoClock converts [-]HH:MM:SS[.ffffff] into the time part of an ISO 8601 duration
+func isoClock(s string) (string, bool) {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign = "-"
+	}
+	parts := strings.Split(strings.TrimLeft(s, "+-"), ":")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	hours, errH := strconv.Atoi(parts[0])
+	minutes, errM := strconv.Atoi(parts[1])
+	seconds, errS := strconv.ParseFloat(parts[2], 64)
+	if errH != nil || errM != nil || errS != nil {
+		return "", false
+	}
+
+	clock := ""
+	if hours != 0 {
+		clock += fmt.Sprintf("%s%dH", sign, hours)
+	}
+	if minutes != 0 {
+		clock += fmt.Sprintf("%s%dM", sign, minutes)
+	}
+	if seconds != 0 {
+		clock += sign + strconv.FormatFloat(seconds, 'f', -1, 64) + "S"
+	}
+	return clock, true
+}
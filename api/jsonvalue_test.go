@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJSONDecoder(t *testing.T) {
+	testCases := []struct {
+		dbType        string
+		value         interface{}
+		numericString bool
+		expected      string
+	}{
+		{"TEXT", []byte("eth0"), false, `"eth0"`},
+		{"INT8", int64(42), false, `42`},
+		{"NUMERIC", []byte("12345678901234567890.123"), false, `12345678901234567890.123`},
+		{"NUMERIC", []byte("12345678901234567890.123"), true, `"12345678901234567890.123"`},
+		{"NUMERIC", []byte("NaN"), false, `"NaN"`},
+		{"FLOAT8", math.Inf(1), false, `"+Inf"`},
+		{"_TEXT", []byte(`{ops,"a,b",NULL}`), false, `["ops","a,b",null]`},
+		{"_INT4", []byte("{1,2,3}"), false, `[1,2,3]`},
+		{"_NUMERIC", []byte("{1.5,NaN}"), false, `[1.5,"NaN"]`},
+		{"_BOOL", []byte("{t,f}"), false, `[true,false]`},
+		{"_INT4", []byte("{{1,2},{3,4}}"), false, `"{{1,2},{3,4}}"`},
+		{"JSONB", []byte(`{"a": 1}`), false, `{"a":1}`},
+		{"INTERVAL", []byte("1 year 2 mons 3 days 04:05:06.5"), false, `"P1Y2M3DT4H5M6.5S"`},
+		{"INTERVAL", []byte("-1 days +02:00:00"), false, `"P-1DT2H"`},
+		{"INTERVAL", []byte("-00:00:01"), false, `"PT-1S"`},
+		{"INTERVAL", []byte("00:00:00"), false, `"PT0S"`},
+		{"UUID", []byte("A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11"), false, `"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"`},
+		{"INET", []byte("10.0.0.1"), false, `"10.0.0.1"`},
+		{"BYTEA", []byte{0xde, 0xad}, false, `"\\xdead"`},
+		{"TIMESTAMPTZ", time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 3600)), false, `"2024-03-01T12:30:00+01:00"`},
+		{"TIMESTAMPTZ", []byte("infinity"), false, `"infinity"`},
+		{"DATE", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), false, `"2024-03-01"`},
+		{"TEXT", nil, false, `null`},
+	}
+
+	for i, tc := range testCases {
+		valueJSON, err := json.Marshal(newJSONDecoder(tc.dbType, tc.numericString)(tc.value))
+		if err != nil {
+			t.Errorf("test number %d: %v", i, err)
+			continue
+		}
+		if string(valueJSON) != tc.expected {
+			t.Errorf("test number %d: expected %s, got %s", i, tc.expected, valueJSON)
+		}
+	}
+}
+
+func TestStreamJSONTyped(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "groups", "rate"},
+		Types:   []string{"TEXT", "_TEXT", "NUMERIC"},
+		Rows: [][]driver.Value{
+			{"eth0", []byte("{ops,admin}"), []byte("0.25")},
+		},
+	}
+
+	expected := `[{"device":"eth0","groups":["ops","admin"],"rate":0.25}]`
+	for _, format := range []string{"json", "json_", "jsonmem2", "ndjson"} {
+		w := httptest.NewRecorder()
+		encodeResponse(w, queryFake(t, result), &RequestData{Format: format})
+
+		var rows []map[string]interface{}
+		if format == "ndjson" {
+			var row map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &row); err != nil {
+				t.Errorf("format %s: %v", format, err)
+				continue
+			}
+			rows = append(rows, row)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+			t.Errorf("format %s: %v", format, err)
+			continue
+		}
+
+		got, _ := json.Marshal(rows)
+		if string(got) != expected {
+			t.Errorf("format %s: expected %s, got %s", format, expected, got)
+		}
+	}
+}
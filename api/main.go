@@ -3,23 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var DB *sql.DB
@@ -88,510 +86,111 @@ var Queries = map[string]string{
 }
 
 type RequestData struct {
-	Gzip        bool
-	Format      string
-	RawQuery    string
-	Query       string
-	GroupByKey  string
-	GroupByKey2 string
-	Params      []string
-	Limit       string
-}
-
-func streamJSONGroupedDeep(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	groupedResults := make(map[string]map[string][]map[string]interface{})
-
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	for rows.Next() {
-		values := make([]interface{}, len(cols))
-		pointers := make([]interface{}, len(cols))
-		for i := range values {
-			pointers[i] = &values[i]
-		}
-
-		if err := rows.Scan(pointers...); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		result := make(map[string]interface{})
-		var groupKeyLevel1, groupKeyLevel2 string
-		for i, colName := range cols {
-			val := pointers[i].(*interface{})
-			if bytes, ok := (*val).([]byte); ok {
-				result[colName] = string(bytes)
-			} else {
-				result[colName] = *val
-			}
-
-			if colName == requestData.GroupByKey {
-				groupKeyLevel1 = fmt.Sprintf("%v", result[colName])
-			}
-			if colName == requestData.GroupByKey2 {
-				groupKeyLevel2 = fmt.Sprintf("%v", result[colName])
-			}
-		}
-
-		if _, exists := groupedResults[groupKeyLevel1]; !exists {
-			groupedResults[groupKeyLevel1] = make(map[string][]map[string]interface{})
-		}
-		groupedResults[groupKeyLevel1][groupKeyLevel2] = append(groupedResults[groupKeyLevel1][groupKeyLevel2], result)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(groupedResults); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+	Format    string
+	RawQuery  string
+	Query     string
+	GroupBy   []string
+	Params    []string
+	Limit     string
+	Pivot     *PivotSpec
+	BatchSize int
+	// Numerics are written as JSON strings instead of numbers
+	NumericString bool
+	// Dialect options of the CSV formats
+	CSV *CSVOptions
+	// Node or endpoint of the request, names downloads
+	Name string
+	// Node and field of the result columns, when the query is generated
+	Sources map[string]ColumnSource
+	// Time the request was parsed, for the elapsed time of the metadata
+	Start time.Time
+	// ID of the request, reported by the envelope format
+	QueryID string
+	// Query that ran and the time the database took until it returned the first rows
+	SQL       string
+	QueryTime time.Duration
+	// Rows skipped by the cursor of the request
+	Offset int
+	// Notes about the request for the client, reported by the envelope format
+	Warnings []string
 }
 
-// shoudl be optimized
-func streamJSON(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	cols, err := rows.Columns()
+// streamJSON writes the rows as JSON array of objects, with the fields in
+// query order. A failing query ends the array with the error sentinel.
+func streamJSON(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		return
+		return nil
 	}
+	decoders := s.JSONDecoders(requestData)
 
-	w.Header().Set("Content-Type", "application/json")
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
 	w.WriteHeader(http.StatusOK)
 
-	// Begin the JSON array
-	w.Write([]byte("["))
-
+	writer.Write([]byte("["))
 	isFirst := true
-	for rows.Next() {
-		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
-
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
-		}
-
-		rows.Scan(valuePtrs...)
-
-		var entryBuilder strings.Builder
-		entryBuilder.WriteString("{")
-
-		for i, colName := range cols {
-			var v interface{} = values[i]
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-
-			// Escape strings and handle special JSON characters
-			colNameJSON, _ := json.Marshal(colName)
-			valueJSON, _ := json.Marshal(v)
-
-			if i != 0 {
-				entryBuilder.WriteString(",")
-			}
-			entryBuilder.WriteString(fmt.Sprintf("%s:%s", colNameJSON, valueJSON))
-		}
-
-		entryBuilder.WriteString("}")
-
-		// If it's not the first row, write a comma separator
+	for s.Next() {
 		if isFirst {
 			isFirst = false
 		} else {
-			w.Write([]byte(","))
+			writer.Write([]byte(","))
 		}
-
-		w.Write([]byte(entryBuilder.String()))
-	}
-
-	// End the JSON array
-	w.Write([]byte("]"))
-}
-
-func streamJSON_no_order(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	// Begin the JSON array
-	w.Write([]byte("["))
-
-	isFirst := true
-	for rows.Next() {
-		// Create a slice of interface{}'s to represent each column
-		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
-
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
+		if _, err := writer.Write(s.JSONObject(decoders)); err != nil {
+			return err
 		}
-
-		rows.Scan(valuePtrs...)
-
-		// Create map to hold the name:value pairs
-		entry := make(map[string]interface{})
-
-		for i, colName := range cols {
-			var v interface{} = values[i]
-			// Convert []byte type to string for JSON encoding
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-			entry[colName] = v
-		}
-
-		// If it's not the first row, write a comma separator
-		if isFirst {
-			isFirst = false
-		} else {
-			w.Write([]byte(","))
-		}
-
-		if err := json.NewEncoder(w).Encode(entry); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	}
+	if err := s.Err(); err != nil {
+		if !isFirst {
+			writer.Write([]byte(","))
 		}
+		writer.Write(errorSentinel(err))
+		writer.Write([]byte("]"))
+		return reportedError{err}
 	}
-
-	// End the JSON array
-	w.Write([]byte("]"))
+	writer.Write([]byte("]"))
+	return nil
 }
-func streamJSON_MEM(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
 
-	w.Header().Set("Content-Type", "application/json")
+// streamJSONRows writes rows that hold a JSON object each, as built by the
+// nested or jsonpq queries, as JSON array
+func streamJSONRows(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
 	w.WriteHeader(http.StatusOK)
 
-	// Begin the JSON array
-	bw := bufio.NewWriter(w)
-	bw.Write([]byte("["))
-
-	values := make([]interface{}, len(cols))
-	valuePtrs := make([]interface{}, len(cols))
-	entry := make(map[string]interface{}, len(cols))
-
+	writer.Write([]byte("["))
 	isFirst := true
+	var err error
 	for rows.Next() {
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
-		}
-
-		rows.Scan(valuePtrs...)
-
-		for i, colName := range cols {
-			var v interface{} = values[i]
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-			entry[colName] = v
+		var object sql.RawBytes
+		if err = rows.Scan(&object); err != nil {
+			break
 		}
 
 		if isFirst {
 			isFirst = false
 		} else {
-			bw.Write([]byte(","))
+			writer.Write([]byte(","))
 		}
-
-		if err := json.NewEncoder(bw).Encode(entry); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		if _, err := writer.Write(object); err != nil {
+			return err
 		}
 	}
-
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	if err == nil {
+		err = rows.Err()
 	}
-
-	bw.Write([]byte("]"))
-	bw.Flush()
-}
-
-func streamCSV(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
-
-	writer := csv.NewWriter(w)
-	defer writer.Flush()
-
-	cols, err := rows.Columns()
 	if err != nil {
-		http.Error(w, "Failed to get columns: "+err.Error(), 500)
-		return
-	}
-
-	if err := writer.Write(cols); err != nil {
-		http.Error(w, "Failed to write header row: "+err.Error(), 500)
-		return
-	}
-
-	columnValues := make([]interface{}, len(cols))
-	columnPointers := make([]interface{}, len(cols))
-	for rows.Next() {
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-
-		if err := rows.Scan(columnPointers...); err != nil {
-			http.Error(w, "Failed to scan row: "+err.Error(), 500)
-			return
-		}
-
-		row := make([]string, len(cols))
-		for i, col := range columnValues {
-			switch value := col.(type) {
-			case []byte:
-				row[i] = string(value) // Convert []byte to string
-			default:
-				row[i] = fmt.Sprintf("%v", col)
-			}
-		}
-
-		if err := writer.Write(row); err != nil {
-			http.Error(w, "Failed to write data row: "+err.Error(), 500)
-			return
+		if !isFirst {
+			writer.Write([]byte(","))
 		}
+		writer.Write(errorSentinel(err))
+		writer.Write([]byte("]"))
+		return reportedError{err}
 	}
-}
-func streamCSV2(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
-
-	const bufferSize = 2 * 1024 * 1024 // 2MB
-	bw := bufio.NewWriterSize(w, bufferSize)
-	writer := csv.NewWriter(bw)
-	defer writer.Flush()
-
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, "Failed to get columns: "+err.Error(), 500)
-		return
-	}
-
-	if err := writer.Write(cols); err != nil {
-		http.Error(w, "Failed to write header row: "+err.Error(), 500)
-		return
-	}
-
-	columnValues := make([]interface{}, len(cols))
-	columnPointers := make([]interface{}, len(cols))
-	for rows.Next() {
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-
-		if err := rows.Scan(columnPointers...); err != nil {
-			http.Error(w, "Failed to scan row: "+err.Error(), 500)
-			return
-		}
-
-		row := make([]string, len(cols))
-		for i, col := range columnValues {
-			switch value := col.(type) {
-			case []byte:
-				row[i] = string(value) // Convert []byte to string
-			default:
-				row[i] = fmt.Sprintf("%v", col)
-			}
-		}
-
-		if err := writer.Write(row); err != nil {
-			http.Error(w, "Failed to write data row: "+err.Error(), 500)
-			return
-		}
-	}
-
-	if err = bw.Flush(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-}
-func streamCSV3(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
-
-	const bufferSize = 2 * 1024 * 1024 // 2MB
-	bw := bufio.NewWriterSize(w, bufferSize)
-	writer := csv.NewWriter(bw)
-	defer writer.Flush()
-
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, "Failed to get columns: "+err.Error(), 500)
-		return
-	}
-
-	if err := writer.Write(cols); err != nil {
-		http.Error(w, "Failed to write header row: "+err.Error(), 500)
-		return
-	}
-
-	columnValues := make([]interface{}, len(cols))
-	columnPointers := make([]interface{}, len(cols))
-	row := make([]string, len(cols))
-	for i := range columnValues {
-		columnPointers[i] = &columnValues[i]
-	}
-
-	for rows.Next() {
-		if err := rows.Scan(columnPointers...); err != nil {
-			http.Error(w, "Failed to scan row: "+err.Error(), 500)
-			return
-		}
-
-		for i, col := range columnValues {
-			switch value := col.(type) {
-			case nil:
-				row[i] = "<nil>"
-			case []byte:
-				row[i] = string(value)
-			case string:
-				if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
-					// Remove curly braces and replace comma with ';'
-					// or another character of choice for arrays
-					row[i] = strings.Trim(value, "{}")
-					row[i] = strings.Replace(row[i], ",", ";", -1)
-				} else {
-					row[i] = value
-				}
-			default:
-				row[i] = fmt.Sprintf("%v", col)
-			}
-		}
-
-		if err := writer.Write(row); err != nil {
-			http.Error(w, "Failed to write data row: "+err.Error(), 500)
-			return
-		}
-	}
-
-	if err = bw.Flush(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-}
-
-func streamJSONGrouped(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	// Define the data structure for grouped results
-	groupedResults := make(map[string][]map[string]interface{})
-
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	for rows.Next() {
-		values := make([]interface{}, len(cols))
-		pointers := make([]interface{}, len(cols))
-		for i := range values {
-			pointers[i] = &values[i]
-		}
-
-		if err := rows.Scan(pointers...); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		result := make(map[string]interface{})
-		var groupKey string
-		for i, colName := range cols {
-			val := pointers[i].(*interface{})
-			if bytes, ok := (*val).([]byte); ok {
-				result[colName] = string(bytes)
-			} else {
-				result[colName] = *val
-			}
-
-			// If this column is the grouping key, save its value for later use
-			if colName == requestData.GroupByKey {
-				groupKey = fmt.Sprintf("%v", result[colName])
-			}
-
-		}
-
-		// Append this row's data to the appropriate group in the map
-		groupedResults[groupKey] = append(groupedResults[groupKey], result)
-	}
-
-	// Convert the map to JSON and write it out
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(groupedResults); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-}
-
-func streamJSONWithPQ(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	defer rows.Close()
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	// Begin the JSON array
-	w.Write([]byte("["))
-
-	isFirst := true
-	for rows.Next() {
-		var rowData string
-		if err := rows.Scan(&rowData); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		// If it's not the first row, write a comma separator
-		if isFirst {
-			isFirst = false
-		} else {
-			w.Write([]byte(","))
-		}
-
-		w.Write([]byte(rowData))
-	}
-
-	// End the JSON array
-	w.Write([]byte("]"))
-}
-
-func encodeResponse(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-
-	switch requestData.Format {
-	case "json":
-		streamJSON(w, rows, requestData)
-	case "json_":
-		streamJSON_no_order(w, rows, requestData)
-	case "jsonmem2":
-		streamJSON_MEM2(w, rows, requestData)
-	case "jsonpq":
-		streamJSONWithPQ(w, rows, requestData)
-	case "csv":
-		streamCSV(w, rows, requestData)
-	case "csv2":
-		streamCSV2(w, rows, requestData)
-	case "csv3":
-		streamCSV3(w, rows, requestData)
-	case "jsonGrouped":
-		if requestData.GroupByKey2 != "" {
-			streamJSONGroupedDeep(w, rows, requestData)
-		} else {
-			streamJSONGrouped(w, rows, requestData)
-		}
-	default:
-		http.Error(w, "Unsupported format", http.StatusBadRequest)
-	}
-
+	writer.Write([]byte("]"))
+	return nil
 }
 
 func parseURL(r *http.Request) (noun string, params []string, err error) {
@@ -621,25 +220,58 @@ func parseURL(r *http.Request) (noun string, params []string, err error) {
 
 func parseInputGen(r *http.Request) (*RequestData, error) {
 	rawQuery := r.URL.RawQuery
-	format := r.URL.Query().Get("format")
-	if format == "" {
-		format = "json"
+	format, err := negotiateFormat(r)
+	if err != nil {
+		return nil, err
 	}
 
 	limit := r.URL.Query().Get("limit")
+	offset, err := parseCursor(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
 
-	groupByKey := r.URL.Query().Get("groupby")
-	if format == "json" && groupByKey != "" {
+	groupBy := parseGroupBy(r.URL.Query())
+	if format == "json" && len(groupBy) > 0 {
 		format = "jsonGrouped"
 	}
-	groupByKey2 := r.URL.Query().Get("groupby2")
+
+	pivot, err := parsePivot(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := parseBatchSize(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	numericString, err := parseNumericString(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	csvOptions, err := parseCSVOptions(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
 
 	reqData := &RequestData{
-		Format:      format,
-		RawQuery:    rawQuery,
-		GroupByKey:  groupByKey,
-		GroupByKey2: groupByKey2,
-		Limit:       limit,
+		Format:        format,
+		RawQuery:      rawQuery,
+		GroupBy:       groupBy,
+		Limit:         limit,
+		Pivot:         pivot,
+		BatchSize:     batchSize,
+		NumericString: numericString,
+		CSV:           csvOptions,
+		Name:          r.URL.Query().Get("dn"),
+		Start:         time.Now(),
+		QueryID:       newQueryID(),
+		Offset:        offset,
+	}
+	if limit != "" && r.URL.Query().Get("orderby") == "" && r.URL.Query().Get("sample") == "" {
+		reqData.Warnings = append(reqData.Warnings, "limit without orderby returns any of the rows, pages of next_cursor may overlap")
 	}
 
 	return reqData, nil
@@ -661,23 +293,53 @@ func parseInput(r *http.Request) (*RequestData, error) {
 
 	}
 
-	format := r.URL.Query().Get("format")
-	if format == "" {
-		format = "json"
+	format, err := negotiateFormat(r)
+	if err == nil {
+		err = checkGenOnlyFormat(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := parseCursor(r.URL.Query())
+	if err != nil {
+		return nil, err
 	}
 
-	groupByKey := r.URL.Query().Get("groupby")
-	if format == "json" && groupByKey != "" {
+	groupBy := parseGroupBy(r.URL.Query())
+	if format == "json" && len(groupBy) > 0 {
 		format = "jsonGrouped"
 	}
 
+	batchSize, err := parseBatchSize(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	numericString, err := parseNumericString(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	csvOptions, err := parseCSVOptions(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
 	return &RequestData{
-		Gzip:        strings.Contains(strings.ToLower(r.Header.Get("Accept-Encoding")), "gzip"),
-		Format:      format,
-		Query:       query,
-		GroupByKey:  groupByKey,
-		GroupByKey2: r.URL.Query().Get("groupby2"),
-		Params:      params,
+		Format:        format,
+		RawQuery:      r.URL.RawQuery,
+		Query:         query,
+		GroupBy:       groupBy,
+		Params:        params,
+		Limit:         r.URL.Query().Get("limit"),
+		BatchSize:     batchSize,
+		NumericString: numericString,
+		CSV:           csvOptions,
+		Name:          noun,
+		Start:         time.Now(),
+		QueryID:       newQueryID(),
+		Offset:        offset,
 	}, nil
 }
 func countPlaceholders(query string) int {
@@ -737,12 +399,32 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := DB.Query(query, params...)
+	// filter, field, orderby and limit are applied on top of the static query
+	urlQueryParams := r.URL.Query()
+	if wantsSubQuery(urlQueryParams) {
+		columns, err := subQueryColumns(DB, query, params)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		query, params, err = ConstructSubQuery(query, params, columns, urlQueryParams)
+		log.Printf("query %s: subquery %s", reqData.QueryID, query)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	reqData.SQL = reqData.groupQuery(query)
+	queryStart := time.Now()
+	rows, err := DB.Query(reqData.SQL, params...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	defer rows.Close()
+	reqData.QueryTime = time.Since(queryStart)
 
 	encodeResponse(w, rows, reqData)
 
@@ -785,182 +467,6 @@ func QueriesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(queryInfoList)
 }
 
-type Writer interface {
-	io.Writer
-	Flush() error
-}
-
-func streamJSON_MEM2(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	var writer Writer
-	if requestData.Gzip {
-		w.Header().Set("Content-Encoding", "gzip")
-		gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		defer gw.Close()
-		writer = gw
-	} else {
-		bw := bufio.NewWriter(w)
-		defer bw.Flush()
-		writer = bw
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err = writer.Write([]byte("[")); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	values := make([]interface{}, len(cols))
-	valuePtrs := make([]interface{}, len(cols))
-	entry := make(map[string]interface{}, len(cols))
-	colNamesInJSON := precomputeJSONColNames(cols)
-
-	isFirst := true
-	for rows.Next() {
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
-		}
-
-		rows.Scan(valuePtrs...)
-
-		for i, jsonColName := range colNamesInJSON {
-			var v interface{} = values[i]
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-			entry[jsonColName] = v
-		}
-
-		if isFirst {
-			isFirst = false
-		} else {
-			if _, err = writer.Write([]byte(",")); err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-		}
-
-		if err := json.NewEncoder(writer).Encode(entry); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	if _, err = writer.Write([]byte("]")); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	if err = writer.Flush(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-}
-
-// precomputeJSONColNames computes the JSON column names in advance to avoid overhead during row processing
-func precomputeJSONColNames(cols []string) []string {
-	names := make([]string, len(cols))
-	for i, col := range cols {
-		// Convert col into its JSON representation (e.g., handle camelCasing or other transformations)
-		// Here, it's a placeholder and assumes the column name does not change.
-		names[i] = col
-	}
-	return names
-}
-func streamJSON3(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) {
-	cols, err := rows.Columns()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	const bufferSize = 2 * 1024 * 1024 // 2MB
-	bw := bufio.NewWriterSize(w, bufferSize)
-	encoder := json.NewEncoder(bw) // Initialize the encoder here
-
-	if _, err = bw.Write([]byte("[")); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	values := make([]interface{}, len(cols))
-	valuePtrs := make([]interface{}, len(cols))
-	entry := make(map[string]interface{}, len(cols))
-	colNamesInJSON := precomputeJSONColNames(cols)
-
-	if rows.Next() {
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
-		}
-		rows.Scan(valuePtrs...)
-
-		for i, jsonColName := range colNamesInJSON {
-			var v interface{} = values[i]
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-			entry[jsonColName] = v
-		}
-		if err := encoder.Encode(entry); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-	}
-
-	for rows.Next() {
-		if _, err = bw.Write([]byte(",")); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		for i := 0; i < len(cols); i++ {
-			valuePtrs[i] = &values[i]
-		}
-		rows.Scan(valuePtrs...)
-
-		for i, jsonColName := range colNamesInJSON {
-			var v interface{} = values[i]
-			if b, ok := v.([]byte); ok {
-				v = string(b)
-			}
-			entry[jsonColName] = v
-		}
-		if err := encoder.Encode(entry); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	if _, err = bw.Write([]byte("]")); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	if err = bw.Flush(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-}
-
 func LoggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
@@ -1007,25 +513,48 @@ func SMQueryOptionsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func cleanInputGen(reqData *RequestData) (string, []interface{}, error) {
+// cleanInputGen builds the query of the gen parameters. With format=jsonpq
+// Postgres encodes every row as JSON object.
+func cleanInputGen(db Queryer, reqData *RequestData) (string, []interface{}, error) {
+	query, values, err := buildInputGen(db, reqData)
+	if err != nil || reqData.Format != "jsonpq" {
+		return query, values, err
+	}
+	return fmt.Sprintf("SELECT row_to_json(jsonpq_rows) FROM (%s) AS jsonpq_rows", trimQuery(query)), values, nil
+}
+
+func buildInputGen(db Queryer, reqData *RequestData) (string, []interface{}, error) {
+	if reqData.Pivot != nil {
+		if reqData.Format == "nested" {
+			return "", nil, fmt.Errorf("pivot can't be combined with the nested format")
+		}
+		return cleanInputPivot(db, reqData)
+	}
+	if reqData.Format == "nested" {
+		return cleanInputNested(db, reqData)
+	}
+
 	// Convert RawQuery back into url.Values
 	urlQueryParams, err := url.ParseQuery(reqData.RawQuery)
 	if err != nil {
 		return "", nil, err
 	}
 
-	query, valuesMap, err := ConstructQuery(urlQueryParams)
+	qp, err := ParseQueryParams(urlQueryParams)
 	if err != nil {
 		return "", nil, err
 	}
-
-	// Assuming valuesMap is map[string]string, but you want to convert values into a slice of interface{}
-	var queryParams []interface{}
-	for _, value := range valuesMap {
-		queryParams = append(queryParams, value)
+	if len(qp.Selects) == 0 {
+		catalog, err := loadCatalog(db)
+		if err != nil {
+			return "", nil, err
+		}
+		qp.useCatalog(catalog)
 	}
+	reqData.Sources = qp.columnSources()
 
-	return query, queryParams, nil
+	query, values := BuildQuery(qp)
+	return query, values, nil
 }
 
 func QueryGenHandler(w http.ResponseWriter, r *http.Request) {
@@ -1035,7 +564,43 @@ func QueryGenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query, params, err := cleanInputGen(reqData)
+	// Filters on uploaded value lists run in a transaction holding the lists
+	var db Queryer = DB
+	urlQueryParams := r.URL.Query()
+	qp, err := ParseQueryParams(urlQueryParams)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(qp.Lists) > 0 {
+		lists, err := parseValueLists(r)
+		if err == nil {
+			err = checkValueLists(qp.Lists, lists)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		tx, err := DB.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := loadValueLists(tx, qp.Lists, lists); err != nil {
+			if _, ok := err.(*ValueListError); ok {
+				http.Error(w, err.Error(), 400)
+			} else {
+				http.Error(w, err.Error(), 500)
+			}
+			return
+		}
+		db = tx
+	}
+
+	query, params, err := cleanInputGen(db, reqData)
 	fmt.Println("query", query)
 	fmt.Println("params", params)
 	if err != nil {
@@ -1043,12 +608,16 @@ func QueryGenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := DB.Query(query, params...)
+	// The query is canceled when the client goes away, e.g. closes its event stream
+	reqData.SQL = reqData.groupQuery(query)
+	queryStart := time.Now()
+	rows, err := db.QueryContext(r.Context(), reqData.SQL, params...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	defer rows.Close()
+	reqData.QueryTime = time.Since(queryStart)
 
 	encodeResponse(w, rows, reqData)
 }
@@ -1065,24 +634,41 @@ type JoinPart struct {
 }
 
 type FilterPart struct {
+	Name        string
 	Operator    string
 	DNPath      string
 	Value       string
 	Placeholder string
 }
 
+// Condition returns the SQL condition of the filter on its placeholder
+func (f FilterPart) Condition() string {
+	return fmt.Sprintf("%s %s", ColumnNameToSQL(f.DNPath), fmt.Sprintf(f.Operator, f.Placeholder))
+}
+
 type OrderBy struct {
 	Direction string
 	Field     string
+	Column    bool // an output column, not a field of a node
 }
 
 type QueryParams struct {
 	MainTable string
+	MainNode  string
 	Selects   []string
 	Joins     []JoinPart
 	Filters   []FilterPart
+	Lists     []ListFilter
 	Order     []OrderBy
 	Limit     string
+	// Rows skipped by the cursor parameter
+	Offset int
+	Sample *SampleSpec
+	// Fields selected when there are no Selects, see useCatalog
+	Columns []CatalogField
+	// Extra SQL conditions, their placeholders follow the filter placeholders
+	Conditions      []string
+	ConditionValues []interface{}
 }
 
 func splitTableAndColumn(full string) (string, string, error) {
@@ -1099,8 +685,12 @@ func ParseQueryParams(params url.Values) (*QueryParams, error) {
 	qp := &QueryParams{}
 	// Parse main table (dn)
 	qp.MainTable = TableNameToSQL(params.Get("dn"))
+	qp.MainNode = params.Get("dn")
 	// Parse select fields
 	qp.Selects = params["field"]
+	if err := checkAliases(qp.Selects); err != nil {
+		return nil, err
+	}
 
 	for _, link := range params["link"] {
 		decodedLink, err := url.QueryUnescape(link)
@@ -1161,18 +751,29 @@ func ParseQueryParams(params url.Values) (*QueryParams, error) {
 	}
 
 	// Parse Filters
-	for counter, filter := range params["filter"] {
+	for _, filter := range params["filter"] {
 		parts := strings.SplitN(filter, ":", 3)
 		fmt.Println(parts)
 		if len(parts) < 3 {
 			return nil, fmt.Errorf("malformed filter parameter: %s", filter)
 		}
 
+		if list, ok := parseListFilter(parts, len(qp.Lists)); ok {
+			qp.Lists = append(qp.Lists, list)
+			continue
+		}
+
+		operator := transOperator(parts[0])
+		if operator == "" {
+			return nil, fmt.Errorf("unknown filter operator: %s", parts[0])
+		}
+
 		fp := FilterPart{
-			Operator:    transOperator(parts[0]),
+			Name:        strings.ToLower(parts[0]),
+			Operator:    operator,
 			DNPath:      parts[1],
 			Value:       parts[2],
-			Placeholder: fmt.Sprintf("$%d", counter+1),
+			Placeholder: fmt.Sprintf("$%d", len(qp.Filters)+1),
 		}
 
 		qp.Filters = append(qp.Filters, fp)
@@ -1190,6 +791,14 @@ func ParseQueryParams(params url.Values) (*QueryParams, error) {
 			return nil, fmt.Errorf("invalid orderby direction: %s. Only ASC or DESC is allowed", parts[0])
 		}
 
+		// A field without a node refers to an output column, as used when
+		// filtering on top of a static query. It is checked against the
+		// columns there and quoted everywhere else.
+		if !strings.Contains(parts[1], ".") {
+			qp.Order = append(qp.Order, OrderBy{Direction: direction, Field: parts[1], Column: true})
+			continue
+		}
+
 		// Splitting the field by the last "."
 		lastDotIndex := strings.LastIndex(parts[1], ".")
 		fieldParts := []string{}
@@ -1230,6 +839,26 @@ func ParseQueryParams(params url.Values) (*QueryParams, error) {
 			return nil, fmt.Errorf("invalid limit value: %s", qp.Limit)
 		}
 	}
+
+	// Parse cursor
+	offset, err := parseCursor(params)
+	if err != nil {
+		return nil, err
+	}
+	qp.Offset = offset
+
+	// Parse sample
+	sample, err := parseSample(params.Get("sample"))
+	if err != nil {
+		return nil, err
+	}
+	if sample != nil && sample.Method == "rows" && len(qp.Order) > 0 {
+		return nil, fmt.Errorf("sample rows can't be combined with orderby")
+	}
+	if sample != nil && sample.Method == "rows" && qp.Offset > 0 {
+		return nil, fmt.Errorf("sample rows can't be combined with cursor")
+	}
+	qp.Sample = sample
 	return qp, nil
 }
 
@@ -1255,27 +884,85 @@ func toAlias(tableName string) string {
 	return strings.ReplaceAll(tableName, ".", "_")
 }
 
-func ConstructQuery(params url.Values) (string, map[string]string, error) {
+// ConstructQuery builds the query of the gen parameters. Without field
+// parameters the fields of the nodes in the catalog are selected, a nil
+// catalog selects *.
+func ConstructQuery(params url.Values, catalog []CatalogField) (string, []interface{}, error) {
 	qp, err := ParseQueryParams(params)
 	if err != nil {
 		return "", nil, err
 	}
+	qp.useCatalog(catalog)
 
+	query, values := BuildQuery(qp)
+	return query, values, nil
+}
+
+// BuildQuery assembles the SQL query and its values for the parsed parameters.
+func BuildQuery(qp *QueryParams) (string, []interface{}) {
 	// Building SELECT clause
-	selectClause := "SELECT "
-	if len(qp.Selects) > 0 {
-		correctedSelects := make([]string, len(qp.Selects))
-		for i, s := range qp.Selects {
-			correctedSelects[i] = ColumnNameToSQL(s)
+	selectClause := "SELECT " + buildSelectList(qp)
+
+	fromClause, values := buildFromClause(qp)
+
+	joinAliases := []string{}
+	for _, join := range qp.Joins {
+		joinAliases = append(joinAliases, toAlias(join.RightTable))
+	}
+	orderClause, limitClause := buildOrderAndLimit(qp, joinAliases)
+
+	query := fmt.Sprintf("%s %s %s %s", selectClause, fromClause, orderClause, limitClause)
+	return query, values
+}
+
+// buildOrderAndLimit assembles the ORDER BY and LIMIT part of the query. The
+// joined aliases break the ties of a seeded rows sample, they have to be in the
+// FROM clause of the query.
+func buildOrderAndLimit(qp *QueryParams, joinAliases []string) (string, string) {
+	// Building orderby
+	orderClause := ""
+	if len(qp.Order) > 0 {
+		orderParts := make([]string, len(qp.Order))
+		for i, order := range qp.Order {
+			field := order.Field
+			if order.Column {
+				field = pq.QuoteIdentifier(field)
+			}
+			orderParts[i] = fmt.Sprintf("%s %s", field, order.Direction)
+		}
+		orderClause = "ORDER BY " + strings.Join(orderParts, ", ")
+	}
+
+	// Building limit
+	limitClause := ""
+	if qp.Limit != "" {
+		limitClause = "LIMIT " + qp.Limit // You've already validated this as a number in the ParseQueryParams function.
+	}
+
+	// A rows sample orders the result randomly, a lower limit still applies
+	if qp.Sample != nil && qp.Sample.Method == "rows" {
+		mainParts := strings.Split(qp.MainTable, " ")
+		orderClause = "ORDER BY " + qp.Sample.Order(mainParts[len(mainParts)-1], joinAliases)
+		if limit, _ := strconv.Atoi(qp.Limit); qp.Limit == "" || limit > qp.Sample.Rows {
+			limitClause = fmt.Sprintf("LIMIT %d", qp.Sample.Rows)
 		}
-		selectClause += strings.Join(correctedSelects, ", ")
-	} else {
-		selectClause += "*"
 	}
 
+	if qp.Offset > 0 {
+		limitClause = strings.TrimSpace(fmt.Sprintf("%s OFFSET %d", limitClause, qp.Offset))
+	}
+	return orderClause, limitClause
+}
+
+// buildFromClause assembles the FROM, JOIN and WHERE part of the query, so
+// it can be shared by queries that select something else than the fields.
+func buildFromClause(qp *QueryParams) (string, []interface{}) {
 	// Building FROM clause
 	fromClauses := []string{}
 	fromClauses = append(fromClauses, fmt.Sprintf("%s", qp.MainTable))
+	if qp.Sample != nil && qp.Sample.TableSample() != "" {
+		fromClauses[0] += " " + qp.Sample.TableSample()
+	}
 
 	// Build JOIN clause
 	// INNER JOIN domain AS domain_alias ON domain_hostfile.ip_address = domain_alias.arp
@@ -1294,42 +981,27 @@ func ConstructQuery(params url.Values) (string, map[string]string, error) {
 		joinClauses = append(joinClauses, joinSQL)
 	}
 
-	// Building WHERE clause
-	valuesMap := make(map[string]string)
+	// Building WHERE clause, values are kept in placeholder order
+	values := []interface{}{}
 	whereClauses := []string{}
 	for _, filter := range qp.Filters {
-		operator := fmt.Sprintf(filter.Operator, filter.Placeholder) // format the operator string here
-		filterSQL := fmt.Sprintf("%s %s", ColumnNameToSQL(filter.DNPath), operator)
-		whereClauses = append(whereClauses, filterSQL)
-
-		valuesMap[filter.Placeholder] = filter.Value
+		whereClauses = append(whereClauses, filter.Condition())
+		values = append(values, filter.Value)
+	}
+	for _, list := range qp.Lists {
+		whereClauses = append(whereClauses, list.Condition())
 	}
+	whereClauses = append(whereClauses, qp.Conditions...)
+	values = append(values, qp.ConditionValues...)
+
 	whereClause := ""
 	if len(whereClauses) > 0 {
 		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
 	}
-	// Building orderby
-	orderClause := ""
-	if len(qp.Order) > 0 {
-		orderParts := make([]string, len(qp.Order))
-		for i, order := range qp.Order {
-			orderParts[i] = fmt.Sprintf("%s %s", order.Field, order.Direction)
-		}
-		orderClause = "ORDER BY " + strings.Join(orderParts, ", ")
-	}
 
-	// Building limit
-	limitClause := ""
-	if qp.Limit != "" {
-		limitClause = "LIMIT " + qp.Limit // You've already validated this as a number in the ParseQueryParams function.
-	}
-
-	// Modify the final assembling line:
 	fromClause := "FROM " + strings.Join(fromClauses, ", ")
 	joinClause := strings.Join(joinClauses, " ")
-	query := fmt.Sprintf("%s %s %s %s %s %s", selectClause, fromClause, joinClause, whereClause, orderClause, limitClause)
-
-	return query, valuesMap, nil
+	return fmt.Sprintf("%s %s %s", fromClause, joinClause, whereClause), values
 }
 
 var SQLOperators = map[string]string{
@@ -1394,11 +1066,22 @@ func main() {
 	http.HandleFunc("/api/help/", LoggingMiddleware(QueriesHandler))
 	http.HandleFunc("/api/", LoggingMiddleware(QueryHandler))
 	http.HandleFunc("/api/gen/", LoggingMiddleware(QueryGenHandler))
+	http.HandleFunc("/api/union/", LoggingMiddleware(UnionHandler))
+	http.HandleFunc("/api/diff/", LoggingMiddleware(DiffHandler))
+	http.HandleFunc("/api/q/", LoggingMiddleware(QueryLangHandler))
+	http.HandleFunc("/api/pipeline/", LoggingMiddleware(PipelineHandler))
+	http.HandleFunc("/api/batch/", LoggingMiddleware(BatchHandler))
+	if os.Getenv(SQL_CONSOLE_ENV) == "true" {
+		if os.Getenv(SQL_CONSOLE_PROXY_SECRET_ENV) == "" {
+			log.Printf("%s is not set, the SQL console refuses every request", SQL_CONSOLE_PROXY_SECRET_ENV)
+		}
+		http.HandleFunc("/api/sql/", LoggingMiddleware(SQLConsoleHandler))
+	}
 
 	go logMemoryUsagePeriodically()
 
 	fmt.Println("Server started on :8080")
-	http.ListenAndServe(SERVER_HOST, nil)
+	http.ListenAndServe(SERVER_HOST, CompressionMiddleware(http.DefaultServeMux))
 }
 func logMemoryUsagePeriodically() {
 	ticker := time.NewTicker(60 * 60 * time.Second)
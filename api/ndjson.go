@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// streamNDJSON writes one JSON object per line, so the result can be read
+// row by row. The output is flushed regularly to reach the client while the
+// query still runs. A failing query ends with the error sentinel as last line.
+func streamNDJSON(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	decoders := s.JSONDecoders(requestData)
+
+	out := newStreamWriter(w)
+	defer out.Flush()
+	w.WriteHeader(http.StatusOK)
+
+	for s.Next() {
+		out.Write(s.JSONObject(decoders))
+		if _, err := out.Write([]byte("\n")); err != nil {
+			return err
+		}
+		if err := out.Row(); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		out.Write(errorSentinel(err))
+		out.Write([]byte("\n"))
+		return reportedError{err}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamNDJSON(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "ip_address", "flags"},
+		Rows: [][]driver.Value{
+			{[]byte("eth0"), []byte("10.0.0.1/32"), int64(2)},
+			{"eth\n1", nil, int64(3)},
+		},
+	}
+	expected := "{\"device\":\"eth0\",\"ip_address\":\"10.0.0.1/32\",\"flags\":2}\n{\"device\":\"eth\\n1\",\"ip_address\":null,\"flags\":3}\n"
+
+	w := httptest.NewRecorder()
+	encodeResponse(w, queryFake(t, result), &RequestData{Format: "ndjson"})
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+	if !w.Flushed {
+		t.Errorf("expected the output to be flushed")
+	}
+
+	handler := CompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(w, queryFake(t, result), &RequestData{Format: "ndjson"})
+	}))
+	r := httptest.NewRequest("GET", "/api/gen/?dn=domain.arp&format=ndjson", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding")
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != expected {
+		t.Errorf("expected %q, got %q", expected, string(body))
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// jsonb_build_object takes at most 100 arguments
+const maxJSONObjectPairs = 50
+
+// nestedField is a key of a nested object with the SQL of its value
+type nestedField struct {
+	Key string
+	SQL string
+}
+
+// jsonObject builds a jsonb object of the fields, split over several
+// jsonb_build_object calls when there are too many.
+func jsonObject(fields []nestedField) string {
+	if len(fields) == 0 {
+		return "'{}'::jsonb"
+	}
+
+	parts := []string{}
+	for start := 0; start < len(fields); start += maxJSONObjectPairs {
+		end := start + maxJSONObjectPairs
+		if end > len(fields) {
+			end = len(fields)
+		}
+		args := []string{}
+		for _, field := range fields[start:end] {
+			args = append(args, pq.QuoteLiteral(field.Key), field.SQL)
+		}
+		parts = append(parts, fmt.Sprintf("jsonb_build_object(%s)", strings.Join(args, ", ")))
+	}
+	return strings.Join(parts, " || ")
+}
+
+// nestedBuilder builds the objects of the nodes along the link tree
+type nestedBuilder struct {
+	qp         *QueryParams
+	uniques    map[string]bool
+	children   map[string][]JoinPart
+	fields     map[string][]nestedField
+	conditions map[string][]string
+}
+
+// node returns the object of a node, the lateral joins of its linked nodes
+// and the conditions on its rows.
+func (b *nestedBuilder) node(node string) (string, string, []string) {
+	alias := toAlias(node)
+
+	object := jsonObject(b.fields[node])
+	if len(b.qp.Selects) == 0 && len(b.qp.Columns) == 0 {
+		object = fmt.Sprintf("(to_jsonb(%s) - %s)", alias, pq.QuoteLiteral(META_RBAC_KEY))
+	}
+
+	laterals := []string{}
+	conditions := append([]string{}, b.conditions[node]...)
+	children := []nestedField{}
+	for _, join := range b.children[node] {
+		childAlias := toAlias(join.RightTable)
+		lateral := "nested_" + childAlias
+
+		childObject, childLaterals, childConditions := b.node(join.RightTable)
+		childConditions = append([]string{fmt.Sprintf("%s.%s = %s.%s", alias, join.LeftColumn, childAlias, join.RightColumn)}, childConditions...)
+		from := fmt.Sprintf("FROM \"%s\" AS %s %s WHERE %s", join.RightTable, childAlias, childLaterals, strings.Join(childConditions, " AND "))
+
+		// A link on a unique field matches one row at most, others can match many
+		var subQuery, value string
+		if b.uniques[join.RightTable+"."+join.RightColumn] {
+			subQuery = fmt.Sprintf("SELECT %s AS value %s LIMIT 1", childObject, from)
+			value = lateral + ".value"
+		} else {
+			subQuery = fmt.Sprintf("SELECT jsonb_agg(%s) AS value %s", childObject, from)
+			value = fmt.Sprintf("coalesce(%s.value, '[]'::jsonb)", lateral)
+		}
+
+		laterals = append(laterals, fmt.Sprintf("LEFT JOIN LATERAL (%s) AS %s ON true", subQuery, lateral))
+		if join.JoinType == "INNER" {
+			conditions = append(conditions, lateral+".value IS NOT NULL")
+		}
+		children = append(children, nestedField{Key: join.RightTable, SQL: value})
+	}
+
+	if len(children) > 0 {
+		object += " || " + jsonObject(children)
+	}
+	return object, strings.Join(laterals, " "), conditions
+}
+
+// ConstructNestedQuery builds one JSON object per row of the main node, with
+// the rows of every linked node embedded under the name of the node. A link
+// on a unique field embeds an object, other links an array. Filters apply to
+// the rows of their node, an inner link drops main rows without linked rows.
+func ConstructNestedQuery(qp *QueryParams, uniques map[string]bool) (string, []interface{}, error) {
+	if qp.MainNode == "" {
+		return "", nil, fmt.Errorf("missing main table")
+	}
+
+	b := &nestedBuilder{
+		qp:         qp,
+		uniques:    uniques,
+		children:   map[string][]JoinPart{},
+		fields:     map[string][]nestedField{},
+		conditions: map[string][]string{},
+	}
+
+	nodes := map[string]bool{qp.MainNode: true}
+	for _, join := range qp.Joins {
+		if join.JoinType != "INNER" && join.JoinType != "LEFT" {
+			return "", nil, fmt.Errorf("nested output supports inner and left links only, got %s", strings.ToLower(join.JoinType))
+		}
+		if !nodes[join.LeftTable] {
+			return "", nil, fmt.Errorf("link from %s, which is not linked before", join.LeftTable)
+		}
+		if nodes[join.RightTable] {
+			return "", nil, fmt.Errorf("node %s is linked more than once", join.RightTable)
+		}
+		nodes[join.RightTable] = true
+		b.children[join.LeftTable] = append(b.children[join.LeftTable], join)
+	}
+
+	nodeOf := func(dnPath string) (string, error) {
+		node, _, err := splitTableAndColumn(dnPath)
+		if err != nil {
+			return "", err
+		}
+		if !nodes[node] {
+			return "", fmt.Errorf("node %s is not linked", node)
+		}
+		return node, nil
+	}
+
+	for _, s := range qp.Selects {
+		field, alias := splitAlias(s)
+		node, err := nodeOf(field)
+		if err != nil {
+			return "", nil, err
+		}
+		if alias == "" {
+			_, alias, _ = splitTableAndColumn(field)
+		}
+		b.fields[node] = append(b.fields[node], nestedField{Key: alias, SQL: ColumnNameToSQL(field)})
+	}
+	if len(qp.Selects) == 0 {
+		for _, cf := range qp.Columns {
+			if nodes[cf.Node] {
+				b.fields[cf.Node] = append(b.fields[cf.Node], nestedField{Key: cf.Field, SQL: toAlias(cf.Node) + "." + pq.QuoteIdentifier(cf.Field)})
+			}
+		}
+	}
+
+	// Values keep the placeholder order of the filters
+	values := []interface{}{}
+	for _, filter := range qp.Filters {
+		node, err := nodeOf(filter.DNPath)
+		if err != nil {
+			return "", nil, err
+		}
+		b.conditions[node] = append(b.conditions[node], filter.Condition())
+		values = append(values, filter.Value)
+	}
+	for _, list := range qp.Lists {
+		node, err := nodeOf(list.DNPath)
+		if err != nil {
+			return "", nil, err
+		}
+		b.conditions[node] = append(b.conditions[node], list.Condition())
+	}
+	b.conditions[qp.MainNode] = append(b.conditions[qp.MainNode], qp.Conditions...)
+	values = append(values, qp.ConditionValues...)
+
+	mainAlias := toAlias(qp.MainNode)
+	for _, order := range qp.Order {
+		if !strings.HasPrefix(order.Field, mainAlias+".") {
+			return "", nil, fmt.Errorf("nested output can only be ordered by fields of %s", qp.MainNode)
+		}
+	}
+
+	object, laterals, conditions := b.node(qp.MainNode)
+	from := qp.MainTable
+	if qp.Sample != nil && qp.Sample.TableSample() != "" {
+		from += " " + qp.Sample.TableSample()
+	}
+
+	query := fmt.Sprintf("SELECT %s AS row FROM %s %s", object, from, laterals)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// The linked tables are only in the lateral subqueries, a main row is one row
+	orderClause, limitClause := buildOrderAndLimit(qp, nil)
+	return fmt.Sprintf("%s %s %s", query, orderClause, limitClause), values, nil
+}
+
+// cleanInputNested builds the nested query, looking up the fields and unique fields of the nodes
+func cleanInputNested(db Queryer, reqData *RequestData) (string, []interface{}, error) {
+	urlQueryParams, err := url.ParseQuery(reqData.RawQuery)
+	if err != nil {
+		return "", nil, err
+	}
+
+	qp, err := ParseQueryParams(urlQueryParams)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(qp.Selects) == 0 {
+		catalog, err := loadCatalog(db)
+		if err != nil {
+			return "", nil, err
+		}
+		qp.useCatalog(catalog)
+	}
+
+	uniques, err := loadUniqueFields(db)
+	if err != nil {
+		return "", nil, err
+	}
+	return ConstructNestedQuery(qp, uniques)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestNestedQuery(t *testing.T) {
+	uniques := map[string]bool{"standard.id": true}
+
+	testCases := []struct {
+		Input    string
+		Expected []string
+		Values   []interface{}
+		Err      bool
+	}{
+		{
+			Input: "dn=domain.arp&link=domain.arp.standard_id:standard.id&link=left:standard.id:domain.packages.standard_id&filter=match:domain.arp.device:eth0&filter=istartswith:domain.packages.name:lib&limit=10",
+			Expected: []string{
+				`SELECT (to_jsonb(domain_arp) - '__meta__rbac_read_groups') || jsonb_build_object('standard', nested_standard.value) AS row FROM "domain.arp" AS domain_arp`,
+				`LEFT JOIN LATERAL (SELECT (to_jsonb(standard) - '__meta__rbac_read_groups') || jsonb_build_object('domain.packages', coalesce(nested_domain_packages.value, '[]'::jsonb)) AS value FROM "standard" AS standard`,
+				`LEFT JOIN LATERAL (SELECT jsonb_agg((to_jsonb(domain_packages) - '__meta__rbac_read_groups')) AS value FROM "domain.packages" AS domain_packages  WHERE standard.id = domain_packages.standard_id AND domain_packages.name ILIKE $2 || '%') AS nested_domain_packages ON true`,
+				`WHERE domain_arp.standard_id = standard.id LIMIT 1) AS nested_standard ON true`,
+				`WHERE domain_arp.device = $1 AND nested_standard.value IS NOT NULL  LIMIT 10`,
+			},
+			Values: []interface{}{"eth0", "lib"},
+		},
+		{
+			Input: "dn=domain.arp&link=domain.arp.standard_id:domain.packages.standard_id&field=domain.arp.device as interface&field=domain.packages.name&orderby=desc:domain.arp.device",
+			Expected: []string{
+				`SELECT jsonb_build_object('interface', domain_arp.device) || jsonb_build_object('domain.packages', coalesce(nested_domain_packages.value, '[]'::jsonb)) AS row`,
+				`(SELECT jsonb_agg(jsonb_build_object('name', domain_packages.name)) AS value FROM "domain.packages" AS domain_packages  WHERE domain_arp.standard_id = domain_packages.standard_id)`,
+				`ORDER BY domain_arp.device DESC`,
+			},
+			Values: []interface{}{},
+		},
+		{
+			Input: "dn=domain.arp&link=domain.arp.device_id:standard.id&field=domain.arp.device&field=standard.hostname&sample=rows:10:3",
+			Expected: []string{
+				`ORDER BY md5(domain_arp.ctid::text || '3') LIMIT 10`,
+			},
+			Values: []interface{}{},
+		},
+		{Input: "dn=domain.arp&link=right:domain.arp.standard_id:standard.id", Err: true},
+		{Input: "dn=domain.arp&link=domain.arp.standard_id:standard.id&link=domain.arp.standard_id:standard.id", Err: true},
+		{Input: "dn=domain.arp&link=domain.packages.standard_id:standard.id", Err: true},
+		{Input: "dn=domain.arp&filter=match:domain.packages.name:lib", Err: true},
+		{Input: "dn=domain.arp&link=domain.arp.standard_id:standard.id&orderby=asc:standard.hostname", Err: true},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.Input)
+		qp, err := ParseQueryParams(params)
+		if err != nil {
+			t.Fatalf("test number %d: %v", i+1, err)
+		}
+
+		query, values, err := ConstructNestedQuery(qp, uniques)
+		if (err != nil) != tc.Err {
+			t.Errorf("test number %d: expected error %v, got %v", i+1, tc.Err, err)
+			continue
+		}
+		if tc.Err {
+			continue
+		}
+		for _, expected := range tc.Expected {
+			if !strings.Contains(query, expected) {
+				t.Errorf("test number %d: expected %s in %s", i+1, expected, query)
+			}
+		}
+		if !reflect.DeepEqual(values, tc.Values) {
+			t.Errorf("test number %d: expected values %v, got %v", i+1, tc.Values, values)
+		}
+		if _, err := pg_query.Parse(query); err != nil {
+			t.Errorf("test number %d: query does not parse: %v", i+1, err)
+		}
+	}
+}
+
+func TestJSONObjectChunks(t *testing.T) {
+	fields := []nestedField{}
+	for i := 0; i < maxJSONObjectPairs+1; i++ {
+		fields = append(fields, nestedField{Key: "k", SQL: "1"})
+	}
+	if n := strings.Count(jsonObject(fields), "jsonb_build_object("); n != 2 {
+		t.Errorf("expected 2 jsonb_build_object calls, got %d", n)
+	}
+	if jsonObject(nil) != "'{}'::jsonb" {
+		t.Errorf("expected an empty object, got %s", jsonObject(nil))
+	}
+}
+
+func TestGenOnlyFormats(t *testing.T) {
+	handlers := []struct {
+		Name    string
+		Handler http.HandlerFunc
+		Method  string
+		URL     string
+	}{
+		{Name: "union", Method: "GET", Handler: UnionHandler, URL: "/api/union/?format=nested"},
+		{Name: "diff", Method: "GET", Handler: DiffHandler, URL: "/api/diff/?format=jsonpq"},
+		{Name: "ql", Method: "GET", Handler: QueryLangHandler, URL: "/api/q/?format=jsonpq"},
+		{Name: "pipeline", Method: "POST", Handler: PipelineHandler, URL: "/api/pipeline/?format=nested"},
+		{Name: "static", Method: "GET", Handler: QueryHandler, URL: "/api/list-nodes?format=nested"},
+	}
+	for _, h := range handlers {
+		w := httptest.NewRecorder()
+		h.Handler(w, httptest.NewRequest(h.Method, h.URL, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "only supported on /api/gen") {
+			t.Errorf("%s: expected 400 for a gen only format, got %d %s", h.Name, w.Code, w.Body.String())
+		}
+	}
+
+	params := "dn=domain.arp&field=domain.arp.device&format=jsonpq"
+	query, _, err := cleanInputGen(nil, &RequestData{Format: "jsonpq", RawQuery: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT row_to_json(jsonpq_rows) FROM (SELECT domain_arp.device`
+	if !strings.HasPrefix(query, expected) || !strings.HasSuffix(query, ") AS jsonpq_rows") {
+		t.Errorf("expected the query wrapped in row_to_json, got %s", query)
+	}
+}
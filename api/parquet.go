@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+)
+
+const defaultParquetRowGroupSize = 100000
+
+// streamParquet writes the rows as zstd compressed Parquet file. The schema
+// is the arrow schema of the result, so arrays become repeated fields. Every
+// requestData.BatchSize rows are written as row group, only the current row
+// group is held in memory.
+func streamParquet(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	schema := arrowSchema(s.VisibleTypes())
+
+	rowGroupSize := requestData.BatchSize
+	if rowGroupSize == 0 {
+		rowGroupSize = defaultParquetRowGroupSize
+	}
+
+	properties := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Zstd),
+		parquet.WithMaxRowGroupLength(int64(rowGroupSize)),
+	)
+	// The writer starts the file, and so the response, right away
+	w.Header().Set("Content-Disposition", attachment(requestData, "parquet"))
+	writer, err := pqarrow.NewFileWriter(schema, w, properties, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return err
+	}
+
+	if err := writeArrowBatches(s, schema, rowGroupSize, writer.Write); err != nil {
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+)
+
+func TestStreamParquet(t *testing.T) {
+	result := fakeResult{
+		Columns: []string{"device", "flags", "__meta__rbac_read_groups"},
+		Types:   []string{"TEXT", "INT4", "_TEXT"},
+		Rows: [][]driver.Value{
+			{"eth0", int64(2), []byte("{ops,admin}")},
+			{"eth1", nil, []byte("{ops}")},
+			{"eth2", int64(3), nil},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	encodeResponse(w, queryFake(t, result), &RequestData{Format: "parquet", BatchSize: 2, Name: "domain.arp"})
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=domain.arp.parquet" {
+		t.Errorf("unexpected disposition %s", disposition)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/vnd.apache.parquet" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+
+	reader, err := file.NewParquetReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := reader.NumRowGroups(); n != 2 {
+		t.Errorf("expected 2 row groups, got %d", n)
+	}
+	chunk, err := reader.MetaData().RowGroup(0).ColumnChunk(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Compression() != compress.Codecs.Zstd {
+		t.Errorf("expected zstd compression, got %s", chunk.Compression())
+	}
+	if repetition := reader.MetaData().Schema.Column(2).MaxRepetitionLevel(); repetition != 1 {
+		t.Errorf("expected the array column to be repeated, got repetition level %d", repetition)
+	}
+
+	arrowReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := arrowReader.ReadTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+
+	if table.NumRows() != 3 {
+		t.Fatalf("expected 3 rows, got %d", table.NumRows())
+	}
+	if !arrow.TypeEqual(table.Column(2).DataType(), arrow.ListOf(arrow.BinaryTypes.String)) {
+		t.Errorf("expected a list column, got %s", table.Column(2).DataType())
+	}
+
+	groups := table.Column(2).Data().Chunk(0).(*array.List)
+	start, end := groups.ValueOffsets(0)
+	values := groups.ListValues().(*array.String)
+	if end-start != 2 || values.Value(int(start)) != "ops" || values.Value(int(start)+1) != "admin" {
+		t.Errorf("unexpected read groups %v", groups)
+	}
+	if !table.Column(1).Data().Chunk(0).IsNull(1) {
+		t.Errorf("expected a null flag")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Pipeline is an ordered list of gen queries where a step can filter on the
+// output of an earlier step.
+type Pipeline struct {
+	Steps []PipelineStep `json:"steps"`
+	// final returns the rows of the last step in the requested format, all returns every step as JSON
+	Output string `json:"output"`
+	// Fields of the nodes, selected by steps without field parameters
+	catalog []CatalogField
+}
+
+type PipelineStep struct {
+	Name  string        `json:"name"`
+	Query string        `json:"query"`
+	Use   []PipelineUse `json:"use"`
+}
+
+// PipelineUse limits Field to the values of Column in the output of Step.
+// Mode in passes the values as a list, semi embeds the step as EXISTS subquery.
+type PipelineUse struct {
+	Step   string `json:"step"`
+	Column string `json:"column"`
+	Field  string `json:"field"`
+	Mode   string `json:"mode"`
+}
+
+// ResultSet holds the rows of a query in memory, with the database type of
+// every column for encoding them as JSON
+type ResultSet struct {
+	Columns       []string
+	Types         []string
+	Rows          [][]interface{}
+	NumericString bool
+}
+
+func collectRows(rows *sql.Rows) (*ResultSet, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &ResultSet{Columns: cols, Types: make([]string, len(cols)), Rows: [][]interface{}{}}
+	for i, ct := range columnTypes {
+		rs.Types[i] = ct.DatabaseTypeName()
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		pointers := make([]interface{}, len(cols))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		rs.Rows = append(rs.Rows, values)
+	}
+	return rs, rows.Err()
+}
+
+// postgresText renders a value of a result set the way Postgres prints it,
+// so it parses back into its column type
+func postgresText(dbType string, v interface{}) string {
+	dbType = strings.ToUpper(dbType)
+	switch value := v.(type) {
+	case time.Time:
+		return jsonTime(dbType, value)
+	case string:
+		if dbType == "BYTEA" {
+			return `\x` + hex.EncodeToString([]byte(value))
+		}
+		return value
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// columnValues returns the distinct values of a column as text, NULL is left out
+func (rs *ResultSet) columnValues(column string) ([]string, error) {
+	index := -1
+	for i, col := range rs.Columns {
+		if col == column {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("unknown column: %s", column)
+	}
+
+	dbType := ""
+	if index < len(rs.Types) {
+		dbType = rs.Types[index]
+	}
+
+	seen := map[string]bool{}
+	values := []string{}
+	for _, row := range rs.Rows {
+		if row[index] == nil {
+			continue
+		}
+		value := postgresText(dbType, row[index])
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// MarshalJSON writes the rows as objects that keep the column order
+func (rs *ResultSet) MarshalJSON() ([]byte, error) {
+	decoders := make([]jsonDecoder, len(rs.Columns))
+	for i := range decoders {
+		dbType := ""
+		if i < len(rs.Types) {
+			dbType = rs.Types[i]
+		}
+		decoders[i] = newJSONDecoder(dbType, rs.NumericString)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, row := range rs.Rows {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{")
+		for j, col := range rs.Columns {
+			if j > 0 {
+				buffer.WriteString(",")
+			}
+			colNameJSON, _ := json.Marshal(col)
+			valueJSON, err := json.Marshal(decoders[j](row[j]))
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(colNameJSON)
+			buffer.WriteString(":")
+			buffer.Write(valueJSON)
+		}
+		buffer.WriteString("}")
+	}
+	buffer.WriteString("]")
+	return buffer.Bytes(), nil
+}
+
+func parsePipeline(pipeline *Pipeline) error {
+	if len(pipeline.Steps) == 0 {
+		return fmt.Errorf("pipeline expects at least one step")
+	}
+	if pipeline.Output == "" {
+		pipeline.Output = "final"
+	}
+	if pipeline.Output != "final" && pipeline.Output != "all" {
+		return fmt.Errorf("invalid pipeline output: %s. Only final or all is allowed", pipeline.Output)
+	}
+
+	names := map[string]bool{}
+	for i := range pipeline.Steps {
+		step := &pipeline.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", i+1)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("duplicate step name: %s", step.Name)
+		}
+
+		for j := range step.Use {
+			use := &step.Use[j]
+			if !names[use.Step] {
+				return fmt.Errorf("step %s uses %s, which is not an earlier step", step.Name, use.Step)
+			}
+			if use.Mode == "" {
+				use.Mode = "in"
+			}
+			if use.Mode != "in" && use.Mode != "semi" {
+				return fmt.Errorf("invalid mode %s in step %s. Only in or semi is allowed", use.Mode, step.Name)
+			}
+			if use.Column == "" || use.Field == "" {
+				return fmt.Errorf("step %s needs a column and field to use %s", step.Name, use.Step)
+			}
+		}
+		names[step.Name] = true
+	}
+	return nil
+}
+
+func (p *Pipeline) stepIndex(name string) int {
+	for i, step := range p.Steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastStepPage returns the limit and cursor offset of the last step, they
+// decide whether the result is truncated and where its next page starts
+func (p *Pipeline) lastStepPage() (string, int, error) {
+	params, err := url.ParseQuery(p.Steps[len(p.Steps)-1].Query)
+	if err != nil {
+		return "", 0, err
+	}
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		return "", 0, err
+	}
+	return qp.Limit, qp.Offset, nil
+}
+
+// ConstructStepQuery builds the query of a step with placeholders after offset.
+// In-list uses take the values from results, which holds the rows of earlier steps.
+func (p *Pipeline) ConstructStepQuery(index int, offset int, results map[string]*ResultSet) (string, []interface{}, error) {
+	step := p.Steps[index]
+	params, err := url.ParseQuery(step.Query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		return "", nil, fmt.Errorf("step %s: %v", step.Name, err)
+	}
+	if qp.MainTable == "" {
+		return "", nil, fmt.Errorf("step %s: missing main table", step.Name)
+	}
+	if len(qp.Lists) > 0 {
+		return "", nil, fmt.Errorf("step %s: value lists are only supported on /api/gen", step.Name)
+	}
+	offsetPlaceholders(qp, offset)
+	qp.useCatalog(p.catalog)
+
+	next := offset + len(qp.Filters)
+	for _, use := range step.Use {
+		field := ColumnNameToSQL(use.Field)
+
+		switch use.Mode {
+		case "in":
+			values, err := results[use.Step].columnValues(use.Column)
+			if err != nil {
+				return "", nil, fmt.Errorf("step %s: %v", step.Name, err)
+			}
+			next++
+			qp.Conditions = append(qp.Conditions, fmt.Sprintf("%s = ANY($%d)", field, next))
+			qp.ConditionValues = append(qp.ConditionValues, pq.Array(values))
+		case "semi":
+			subQuery, subValues, err := p.ConstructStepQuery(p.stepIndex(use.Step), next, results)
+			if err != nil {
+				return "", nil, err
+			}
+			next += len(subValues)
+			alias := pq.QuoteIdentifier("step_" + use.Step)
+			qp.Conditions = append(qp.Conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM (%s) AS %s WHERE %s.%s = %s)",
+				trimQuery(subQuery), alias, alias, pq.QuoteIdentifier(use.Column), field))
+			qp.ConditionValues = append(qp.ConditionValues, subValues...)
+		}
+	}
+
+	query, values := BuildQuery(qp)
+	return query, values, nil
+}
+
+// needsRows tells which steps have to run before the last step
+func (p *Pipeline) needsRows() []bool {
+	needed := make([]bool, len(p.Steps))
+	for _, step := range p.Steps {
+		for _, use := range step.Use {
+			if use.Mode == "in" {
+				needed[p.stepIndex(use.Step)] = true
+			}
+		}
+	}
+	if p.Output == "all" {
+		for i := range needed {
+			needed[i] = true
+		}
+	}
+	return needed
+}
+
+// PipelineHandler runs the steps of a pipeline posted as JSON in one
+// REPEATABLE READ transaction, so every step sees the same data.
+func PipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "pipeline expects a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqData, err := parseInputGen(r)
+	if err == nil {
+		err = checkGenOnlyFormat(reqData.Format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	pipeline := &Pipeline{}
+	if err := json.NewDecoder(r.Body).Decode(pipeline); err != nil {
+		http.Error(w, "invalid pipeline: "+err.Error(), 400)
+		return
+	}
+	if err := parsePipeline(pipeline); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if pipeline.Output == "all" && reqData.Format != "json" {
+		http.Error(w, fmt.Sprintf("output all is only returned as json, not %s", reqData.Format), 400)
+		return
+	}
+
+	tx, err := DB.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	if pipeline.catalog, err = loadCatalog(tx); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	last := len(pipeline.Steps) - 1
+	needed := pipeline.needsRows()
+	results := map[string]*ResultSet{}
+	for i, step := range pipeline.Steps {
+		if !needed[i] || (i == last && pipeline.Output == "final") {
+			continue
+		}
+
+		query, params, err := pipeline.ConstructStepQuery(i, 0, results)
+		log.Printf("query %s: pipeline step %s %s", reqData.QueryID, step.Name, query)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		rows, err := tx.Query(query, params...)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("step %s: %v", step.Name, err), 500)
+			return
+		}
+		results[step.Name], err = collectRows(rows)
+		rows.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("step %s: %v", step.Name, err), 500)
+			return
+		}
+		results[step.Name].NumericString = reqData.NumericString
+	}
+
+	if pipeline.Output == "all" {
+		type stepResult struct {
+			Name string     `json:"name"`
+			Rows *ResultSet `json:"rows"`
+		}
+		response := struct {
+			Steps []stepResult `json:"steps"`
+		}{}
+		for _, step := range pipeline.Steps {
+			response.Steps = append(response.Steps, stepResult{Name: step.Name, Rows: results[step.Name]})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	query, params, err := pipeline.ConstructStepQuery(last, 0, results)
+	log.Printf("query %s: pipeline step %s %s", reqData.QueryID, pipeline.Steps[last].Name, query)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// truncated and next_cursor follow the last step, not the URL
+	if reqData.Limit, reqData.Offset, err = pipeline.lastStepPage(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rows, err := tx.Query(reqData.groupQuery(query), params...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	encodeResponse(w, rows, reqData)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestPipelineStepQuery(t *testing.T) {
+	pipeline := &Pipeline{Steps: []PipelineStep{
+		{Name: "ips", Query: "dn=domain.arp&field=domain.arp.ip_address&filter=ip_contains:domain.arp.ip_address:10.0.0.0/8"},
+		{Name: "devices", Query: "dn=domain.address&field=domain.address.standard_id&filter=match:domain.address.type:ipv4",
+			Use: []PipelineUse{{Step: "ips", Column: "ip_address", Field: "domain.address.value"}}},
+		{Name: "packages", Query: "dn=domain.packages&filter=istartswith:domain.packages.name:lib",
+			Use: []PipelineUse{{Step: "devices", Column: "standard_id", Field: "domain.packages.standard_id", Mode: "semi"}}},
+	}}
+	if err := parsePipeline(pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[string]*ResultSet{
+		"ips": {Columns: []string{"ip_address"}, Rows: [][]interface{}{{"10.0.0.1/32"}, {"10.0.0.2/32"}, {"10.0.0.1/32"}, {nil}}},
+	}
+
+	query, values, err := pipeline.ConstructStepQuery(2, 0, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `WHERE domain_packages.name ILIKE $1 || '%' AND EXISTS (SELECT 1 FROM (SELECT domain_address.standard_id FROM "domain.address" AS domain_address  WHERE domain_address.type = $2 AND domain_address.value = ANY($3)) AS "step_devices" WHERE "step_devices"."standard_id" = domain_packages.standard_id)`
+	if !strings.Contains(query, expected) {
+		t.Errorf("expected %s in %s", expected, query)
+	}
+	if _, err := pg_query.Parse(query); err != nil {
+		t.Errorf("query does not parse: %v", err)
+	}
+
+	if len(values) != 3 || values[0] != "lib" || values[1] != "ipv4" {
+		t.Fatalf("unexpected values %v", values)
+	}
+	list, err := values[2].(driver.Valuer).Value()
+	if err != nil || list != `{"10.0.0.1/32","10.0.0.2/32"}` {
+		t.Errorf("expected the distinct ips as list, got %v %v", list, err)
+	}
+}
+
+func TestResultSetColumnValues(t *testing.T) {
+	seen := time.Date(2024, 3, 1, 12, 0, 0, 500000000, time.FixedZone("", 3600))
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.FixedZone("", 0))
+	rs := &ResultSet{
+		Columns: []string{"seen", "day", "hash", "mtu"},
+		Types:   []string{"TIMESTAMPTZ", "DATE", "BYTEA", "INT4"},
+		Rows: [][]interface{}{
+			{seen, day, "\xde\xad", int64(1500)},
+			{seen, nil, "\x00", int64(9000)},
+		},
+	}
+
+	testCases := []struct {
+		Column   string
+		Expected []string
+	}{
+		{Column: "seen", Expected: []string{"2024-03-01T12:00:00.5+01:00"}},
+		{Column: "day", Expected: []string{"2024-03-01"}},
+		{Column: "hash", Expected: []string{`\xdead`, `\x00`}},
+		{Column: "mtu", Expected: []string{"1500", "9000"}},
+	}
+
+	for testNum, testCase := range testCases {
+		values, err := rs.columnValues(testCase.Column)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, testCase.Expected) {
+			t.Errorf("test number %d: expected %v, got %v", testNum+1, testCase.Expected, values)
+		}
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Err   bool
+	}{
+		{Input: `{"steps": [{"query": "dn=domain.arp"}]}`, Err: false},
+		{Input: `{"steps": []}`, Err: true},
+		{Input: `{"steps": [{"query": "dn=domain.arp"}], "output": "some"}`, Err: true},
+		{Input: `{"steps": [{"name": "a", "query": "dn=domain.arp"}, {"name": "a", "query": "dn=domain.arp"}]}`, Err: true},
+		{Input: `{"steps": [{"name": "a", "query": "dn=domain.arp", "use": [{"step": "b", "column": "x", "field": "domain.arp.x"}]}, {"name": "b", "query": "dn=domain.arp"}]}`, Err: true},
+		{Input: `{"steps": [{"name": "a", "query": "dn=domain.arp"}, {"query": "dn=domain.arp", "use": [{"step": "a", "column": "x", "field": "domain.arp.x", "mode": "join"}]}]}`, Err: true},
+	}
+
+	for testNum, testCase := range testCases {
+		pipeline := &Pipeline{}
+		if err := json.Unmarshal([]byte(testCase.Input), pipeline); err != nil {
+			t.Fatal(err)
+		}
+		err := parsePipeline(pipeline)
+		if (err != nil) != testCase.Err {
+			t.Errorf("test number %d: for input %s got error %v", testNum+1, testCase.Input, err)
+		}
+	}
+}
+
+func TestPipelineLastStepPage(t *testing.T) {
+	pipeline := &Pipeline{Steps: []PipelineStep{
+		{Name: "a", Query: "dn=domain.arp&limit=500"},
+		{Name: "b", Query: "dn=domain.arp&orderby=asc:domain.arp.device&limit=10&cursor=" + encodeCursor(20)},
+	}}
+	limit, offset, err := pipeline.lastStepPage()
+	if err != nil || limit != "10" || offset != 20 {
+		t.Errorf("expected the limit and offset of the last step, got %s %d %v", limit, offset, err)
+	}
+}
+
+func TestPipelineOutputAllFormat(t *testing.T) {
+	body := `{"steps": [{"query": "dn=domain.arp"}], "output": "all"}`
+	for _, format := range []string{"csv", "ndjson", "xlsx"} {
+		w := httptest.NewRecorder()
+		PipelineHandler(w, httptest.NewRequest("POST", "/api/pipeline/?format="+format, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("format %s: expected 400 for output all, got %d %s", format, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestResultSetMarshalJSON(t *testing.T) {
+	rs := &ResultSet{Columns: []string{"name", "id"}, Rows: [][]interface{}{{"John", int64(1)}, {nil, int64(2)}}}
+	data, err := json.Marshal(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"name":"John","id":1},{"name":null,"id":2}]`
+	if string(data) != expected {
+		t.Errorf("expected %s but got %s", expected, data)
+	}
+}
+
+func TestResultSetMarshalJSONNumericString(t *testing.T) {
+	rs := &ResultSet{Columns: []string{"total"}, Types: []string{"NUMERIC"}, Rows: [][]interface{}{{[]byte("12345678901234567890.5")}}}
+	for _, numericString := range []bool{false, true} {
+		rs.NumericString = numericString
+		data, err := json.Marshal(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `[{"total":12345678901234567890.5}]`
+		if numericString {
+			expected = `[{"total":"12345678901234567890.5"}]`
+		}
+		if string(data) != expected {
+			t.Errorf("numeric string %v: expected %s but got %s", numericString, expected, data)
+		}
+	}
+}
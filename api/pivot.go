@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPivotColumns = 100
+	maxPivotColumns     = 1000
+	// Postgres truncates longer identifiers, NAMEDATALEN - 1
+	maxIdentifierBytes = 63
+)
+
+// Aggregates allowed for the pivot value, mapped onto their SQL format
+var pivotAggregates = map[string]string{
+	"count":      "count(%s)",
+	"min":        "min(%s)",
+	"max":        "max(%s)",
+	"sum":        "sum(%s)",
+	"avg":        "avg(%s)",
+	"array_agg":  "array_agg(%s)",
+	"string_agg": "string_agg(%s::text, ', ')",
+}
+
+// PivotSpec turns the values of Column into output columns, with one row per
+// Row value and the aggregated Value as cell.
+type PivotSpec struct {
+	Aggregate  string
+	Row        string
+	Column     string
+	Value      string
+	MaxColumns int
+}
+
+// parsePivot parses pivot=<aggregate>:<row field>:<column field>:<value field>
+// and the optional pivotmax column cap. It returns nil when no pivot is requested.
+func parsePivot(params url.Values) (*PivotSpec, error) {
+	pivot := params.Get("pivot")
+	if pivot == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(pivot, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed pivot parameter: %s", pivot)
+	}
+
+	aggregate := strings.ToLower(parts[0])
+	if _, ok := pivotAggregates[aggregate]; !ok {
+		return nil, fmt.Errorf("invalid pivot aggregate: %s", parts[0])
+	}
+
+	spec := &PivotSpec{
+		Aggregate:  aggregate,
+		Row:        parts[1],
+		Column:     parts[2],
+		Value:      parts[3],
+		MaxColumns: defaultPivotColumns,
+	}
+
+	if max := params.Get("pivotmax"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 1 || n > maxPivotColumns {
+			return nil, fmt.Errorf("invalid pivotmax value: %s. Allowed is 1 up to %d", max, maxPivotColumns)
+		}
+		spec.MaxColumns = n
+	}
+	return spec, nil
+}
+
+// ConstructPivotColumnsQuery selects the distinct column values, one more
+// than allowed so exceeding the cap can be detected.
+func ConstructPivotColumnsQuery(qp *QueryParams, spec *PivotSpec) (string, []interface{}) {
+	fromClause, values := buildFromClause(qp)
+	column := ColumnNameToSQL(spec.Column)
+
+	condition := "WHERE"
+	if len(qp.Filters)+len(qp.Lists)+len(qp.Conditions) > 0 {
+		condition = "AND"
+	}
+
+	query := fmt.Sprintf("SELECT DISTINCT %s::text %s %s %s IS NOT NULL ORDER BY 1 LIMIT %d",
+		column, fromClause, condition, column, spec.MaxColumns+1)
+	return query, values
+}
+
+// truncateIdentifier returns the name Postgres uses for an identifier, cut to
+// maxIdentifierBytes without splitting a character
+func truncateIdentifier(name string) string {
+	if len(name) <= maxIdentifierBytes {
+		return name
+	}
+	end := maxIdentifierBytes
+	for end > 0 && !utf8.RuneStart(name[end]) {
+		end--
+	}
+	return name[:end]
+}
+
+// ConstructPivotQuery builds one aggregate per column value, grouped by the
+// row field. Column values that end up with the name of the row field or of
+// another column value are refused, the output columns must be unique.
+func ConstructPivotQuery(qp *QueryParams, spec *PivotSpec, columnValues []string) (string, []interface{}, error) {
+	if len(columnValues) > spec.MaxColumns {
+		return "", nil, fmt.Errorf("pivot on %s produces more than %d columns", spec.Column, spec.MaxColumns)
+	}
+
+	fromClause, values := buildFromClause(qp)
+	row := ColumnNameToSQL(spec.Row)
+	column := ColumnNameToSQL(spec.Column)
+	aggregate := fmt.Sprintf(pivotAggregates[spec.Aggregate], ColumnNameToSQL(spec.Value))
+
+	_, rowName, err := splitTableAndColumn(spec.Row)
+	if err != nil {
+		return "", nil, err
+	}
+
+	names := map[string]string{truncateIdentifier(rowName): rowName}
+	selects := []string{fmt.Sprintf("%s AS %s", row, pq.QuoteIdentifier(rowName))}
+	for _, columnValue := range columnValues {
+		name := truncateIdentifier(columnValue)
+		if other, ok := names[name]; ok {
+			return "", nil, fmt.Errorf("pivot column %q has the same name as %q", columnValue, other)
+		}
+		names[name] = columnValue
+
+		values = append(values, columnValue)
+		selects = append(selects, fmt.Sprintf("%s FILTER (WHERE %s::text = $%d) AS %s",
+			aggregate, column, len(values), pq.QuoteIdentifier(columnValue)))
+	}
+
+	query := fmt.Sprintf("SELECT %s %s GROUP BY %s ORDER BY %s", strings.Join(selects, ", "), fromClause, row, row)
+	if qp.Limit != "" {
+		query += " LIMIT " + qp.Limit
+	}
+	if qp.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", qp.Offset)
+	}
+	return query, values, nil
+}
+
+// cleanInputPivot builds the pivot query, looking up the column values first.
+func cleanInputPivot(db Queryer, reqData *RequestData) (string, []interface{}, error) {
+	spec := reqData.Pivot
+	urlQueryParams, err := url.ParseQuery(reqData.RawQuery)
+	if err != nil {
+		return "", nil, err
+	}
+
+	qp, err := ParseQueryParams(urlQueryParams)
+	if err != nil {
+		return "", nil, err
+	}
+
+	query, values := ConstructPivotColumnsQuery(qp, spec)
+	rows, err := db.Query(query, values...)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	columnValues := []string{}
+	for rows.Next() {
+		var columnValue string
+		if err := rows.Scan(&columnValue); err != nil {
+			return "", nil, err
+		}
+		columnValues = append(columnValues, columnValue)
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	return ConstructPivotQuery(qp, spec, columnValues)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConstructPivotQuery(t *testing.T) {
+	params, _ := url.ParseQuery("dn=domain.packages&filter=istartswith:domain.packages.name:lib&pivot=max:domain.packages.standard_id:domain.packages.name:domain.packages.version&limit=50")
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := parsePivot(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, values := ConstructPivotColumnsQuery(qp, spec)
+	expected := `SELECT DISTINCT domain_packages.name::text FROM "domain.packages" AS domain_packages  WHERE domain_packages.name ILIKE $1 || '%' AND domain_packages.name IS NOT NULL ORDER BY 1 LIMIT 101`
+	if query != expected {
+		t.Errorf("expected %s but got %s", expected, query)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"lib"}) {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	query, values, err = ConstructPivotQuery(qp, spec, []string{"libc", "libssl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `SELECT domain_packages.standard_id AS "standard_id", max(domain_packages.version) FILTER (WHERE domain_packages.name::text = $2) AS "libc", max(domain_packages.version) FILTER (WHERE domain_packages.name::text = $3) AS "libssl" FROM "domain.packages" AS domain_packages  WHERE domain_packages.name ILIKE $1 || '%' GROUP BY domain_packages.standard_id ORDER BY domain_packages.standard_id LIMIT 50`
+	if query != expected {
+		t.Errorf("expected %s but got %s", expected, query)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"lib", "libc", "libssl"}) {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	qp.Offset = 100
+	query, _, err = ConstructPivotQuery(qp, spec, []string{"libc", "libssl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(query, "LIMIT 50 OFFSET 100") {
+		t.Errorf("expected LIMIT 50 OFFSET 100, got %s", query)
+	}
+
+	long := strings.Repeat("x", 63)
+	for _, columnValues := range [][]string{{"libc", "standard_id"}, {long + "a", long + "b"}} {
+		if _, _, err := ConstructPivotQuery(qp, spec, columnValues); err == nil {
+			t.Errorf("expected an error for the duplicate columns %v", columnValues)
+		}
+	}
+	if _, _, err := ConstructPivotQuery(qp, spec, []string{long, long[:62] + "é"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	spec.MaxColumns = 1
+	if _, _, err := ConstructPivotQuery(qp, spec, []string{"libc", "libssl"}); err == nil {
+		t.Errorf("expected an error when the column cap is exceeded")
+	}
+}
+
+func TestParsePivot(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Err   bool
+	}{
+		{Input: "pivot=count:a.b.row:a.b.col:a.b.val", Err: false},
+		{Input: "pivot=count:a.b.row:a.b.col:a.b.val&pivotmax=10", Err: false},
+		{Input: "pivot=median:a.b.row:a.b.col:a.b.val", Err: true},
+		{Input: "pivot=count:a.b.row:a.b.col", Err: true},
+		{Input: "pivot=count:a.b.row:a.b.col:a.b.val&pivotmax=5000", Err: true},
+	}
+
+	for testNum, testCase := range testCases {
+		params, _ := url.ParseQuery(testCase.Input)
+		_, err := parsePivot(params)
+		if (err != nil) != testCase.Err {
+			t.Errorf("test number %d: for input %s got error %v", testNum+1, testCase.Input, err)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The query language is a pipe separated list of stages that compiles into QueryParams:
+//
+//	domain.arp | where device = "eth0" and ip_address << 10.0.0.0/8 | link standard
+//	           | select ip_address, standard.hostname | sort ip_address desc | limit 10
+//
+// Fields without a node belong to the main node.
+
+// Symbolic operators, the named operators of SQLOperators can be used as well
+var queryLangOperators = map[string]string{
+	"=":   "match",
+	"!=":  "notmatch",
+	"<>":  "neq",
+	"<":   "lt",
+	">":   "gt",
+	"<=":  "lte",
+	">=":  "gte",
+	"<<":  "ip_contains",
+	"<<=": "contains_or_eq",
+	">>":  "contained_by",
+	">>=": "contained_by_or_eq",
+	"~":   "regex",
+	"~*":  "iregex",
+}
+
+var queryLangJoinTypes = map[string]bool{"inner": true, "left": true, "right": true, "full": true}
+
+type QueryLangError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *QueryLangError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenPipe
+	tokenComma
+)
+
+type token struct {
+	Kind   tokenKind
+	Text   string
+	Line   int
+	Column int
+}
+
+func (t token) describe() string {
+	if t.Kind == tokenEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.Text)
+}
+
+func isOperatorRune(r rune) bool {
+	return strings.ContainsRune("=!<>~*", r)
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !isOperatorRune(r) && !strings.ContainsRune(`|,"'`, r)
+}
+
+func tokenize(input string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(input)
+	line, column := 1, 1
+
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		start := token{Line: line, Column: column}
+
+		advance := func() {
+			if runes[i] == '\n' {
+				line++
+				column = 1
+			} else {
+				column++
+			}
+			i++
+		}
+
+		switch {
+		case unicode.IsSpace(r):
+			advance()
+			continue
+		case r == '|':
+			start.Kind, start.Text = tokenPipe, "|"
+			advance()
+		case r == ',':
+			start.Kind, start.Text = tokenComma, ","
+			advance()
+		case r == '"' || r == '\'':
+			quote := r
+			advance()
+			var text strings.Builder
+			for {
+				if i >= len(runes) {
+					return nil, &QueryLangError{start.Line, start.Column, "unterminated string"}
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					advance()
+				} else if runes[i] == quote {
+					advance()
+					break
+				}
+				text.WriteRune(runes[i])
+				advance()
+			}
+			start.Kind, start.Text = tokenString, text.String()
+		case isOperatorRune(r) && r != '*':
+			begin := i
+			for i < len(runes) && isOperatorRune(runes[i]) {
+				advance()
+			}
+			start.Kind, start.Text = tokenOperator, string(runes[begin:i])
+			if _, ok := queryLangOperators[start.Text]; !ok {
+				return nil, &QueryLangError{start.Line, start.Column, fmt.Sprintf("unknown operator %s", start.Text)}
+			}
+		case isWordRune(r):
+			begin := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				advance()
+			}
+			start.Kind, start.Text = tokenWord, string(runes[begin:i])
+		default:
+			return nil, &QueryLangError{line, column, fmt.Sprintf("unexpected character %q", r)}
+		}
+		tokens = append(tokens, start)
+	}
+
+	return append(tokens, token{Kind: tokenEOF, Line: line, Column: column}), nil
+}
+
+type queryLangParser struct {
+	tokens []token
+	pos    int
+	node   string
+	qp     *QueryParams
+}
+
+func (p *queryLangParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryLangParser) next() token {
+	t := p.tokens[p.pos]
+	if t.Kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryLangParser) errorf(t token, format string, args ...interface{}) error {
+	return &QueryLangError{t.Line, t.Column, fmt.Sprintf(format, args...)}
+}
+
+func (p *queryLangParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.Kind == tokenWord && strings.EqualFold(t.Text, keyword)
+}
+
+func (p *queryLangParser) expectWord(what string) (token, error) {
+	t := p.next()
+	if t.Kind != tokenWord {
+		return t, p.errorf(t, "expected %s but got %s", what, t.describe())
+	}
+	return t, nil
+}
+
+// field returns the node and field, fields without a node belong to the main node
+func (p *queryLangParser) field() (string, string, error) {
+	t, err := p.expectWord("field")
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.Contains(t.Text, ".") {
+		return p.node, t.Text, nil
+	}
+	node, field, err := splitTableAndColumn(t.Text)
+	if err != nil || node == "" || field == "" {
+		return "", "", p.errorf(t, "malformed field %s", t.Text)
+	}
+	return node, field, nil
+}
+
+// CompileQueryLang compiles a query written in the query language into QueryParams
+func CompileQueryLang(input string) (*QueryParams, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryLangParser{tokens: tokens, qp: &QueryParams{}}
+	node, err := p.expectWord("node")
+	if err != nil {
+		return nil, err
+	}
+	p.node = node.Text
+	p.qp.MainTable = TableNameToSQL(p.node)
+	p.qp.MainNode = p.node
+
+	for p.peek().Kind != tokenEOF {
+		if t := p.next(); t.Kind != tokenPipe {
+			return nil, p.errorf(t, "expected | but got %s", t.describe())
+		}
+
+		stage, err := p.expectWord("stage")
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(stage.Text) {
+		case "where":
+			err = p.parseWhere()
+		case "link":
+			err = p.parseLink()
+		case "select":
+			err = p.parseSelect()
+		case "sort":
+			err = p.parseSort()
+		case "limit":
+			err = p.parseLimit()
+		default:
+			err = p.errorf(stage, "unknown stage %s, expected where, link, select, sort or limit", stage.Text)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if t := p.peek(); t.Kind != tokenPipe && t.Kind != tokenEOF {
+			return nil, p.errorf(t, "unexpected %s after %s", t.describe(), strings.ToLower(stage.Text))
+		}
+	}
+
+	return p.qp, nil
+}
+
+func (p *queryLangParser) parseWhere() error {
+	for {
+		node, field, err := p.field()
+		if err != nil {
+			return err
+		}
+
+		opToken := p.next()
+		var name string
+		switch opToken.Kind {
+		case tokenOperator:
+			name = queryLangOperators[opToken.Text]
+		case tokenWord:
+			name = strings.ToLower(opToken.Text)
+		default:
+			return p.errorf(opToken, "expected operator but got %s", opToken.describe())
+		}
+		operator := transOperator(name)
+		if operator == "" {
+			return p.errorf(opToken, "unknown operator %s", opToken.Text)
+		}
+
+		value := p.next()
+		if value.Kind != tokenWord && value.Kind != tokenString {
+			return p.errorf(value, "expected value but got %s", value.describe())
+		}
+
+		p.qp.Filters = append(p.qp.Filters, FilterPart{
+			Name:        name,
+			Operator:    operator,
+			DNPath:      node + "." + field,
+			Value:       value.Text,
+			Placeholder: fmt.Sprintf("$%d", len(p.qp.Filters)+1),
+		})
+
+		if !p.isKeyword("and") {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// parseLink parses link [inner|left|right|full] <node> [on <field> = <field>].
+// Without on, the standard_id of the main node is linked to standard.id or
+// to the standard_id of the other node.
+func (p *queryLangParser) parseLink() error {
+	joinType := "INNER"
+	if t := p.peek(); t.Kind == tokenWord && queryLangJoinTypes[strings.ToLower(t.Text)] {
+		joinType = strings.ToUpper(p.next().Text)
+	}
+
+	target, err := p.expectWord("node")
+	if err != nil {
+		return err
+	}
+
+	join := JoinPart{
+		JoinType:    joinType,
+		LeftTable:   p.node,
+		LeftColumn:  "standard_id",
+		RightTable:  target.Text,
+		RightColumn: "standard_id",
+	}
+	if target.Text == "standard" {
+		join.RightColumn = "id"
+	}
+
+	if p.isKeyword("on") {
+		p.next()
+		if join.LeftTable, join.LeftColumn, err = p.field(); err != nil {
+			return err
+		}
+		if t := p.next(); t.Kind != tokenOperator || t.Text != "=" {
+			return p.errorf(t, "expected = but got %s", t.describe())
+		}
+		if join.RightTable, join.RightColumn, err = p.field(); err != nil {
+			return err
+		}
+	}
+
+	p.qp.Joins = append(p.qp.Joins, join)
+	return nil
+}
+
+func (p *queryLangParser) parseSelect() error {
+	for {
+		node, field, err := p.field()
+		if err != nil {
+			return err
+		}
+		p.qp.Selects = append(p.qp.Selects, node+"."+field)
+
+		if p.peek().Kind != tokenComma {
+			return nil
+		}
+		p.next()
+	}
+}
+
+func (p *queryLangParser) parseSort() error {
+	for {
+		node, field, err := p.field()
+		if err != nil {
+			return err
+		}
+
+		direction := "ASC"
+		if p.isKeyword("asc") || p.isKeyword("desc") {
+			direction = strings.ToUpper(p.next().Text)
+		}
+		p.qp.Order = append(p.qp.Order, OrderBy{Direction: direction, Field: toAlias(node) + "." + field})
+
+		if p.peek().Kind != tokenComma {
+			return nil
+		}
+		p.next()
+	}
+}
+
+func (p *queryLangParser) parseLimit() error {
+	t, err := p.expectWord("limit")
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(t.Text); err != nil || n < 0 {
+		return p.errorf(t, "invalid limit value: %s", t.Text)
+	}
+	p.qp.Limit = t.Text
+	return nil
+}
+
+// QueryLangHandler runs a query language query from the q parameter or the request body
+func QueryLangHandler(w http.ResponseWriter, r *http.Request) {
+	reqData, err := parseInputGen(r)
+	if err == nil {
+		err = checkGenOnlyFormat(reqData.Format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	input := r.URL.Query().Get("q")
+	if input == "" && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		input = string(body)
+	}
+
+	qp, err := CompileQueryLang(input)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// The limit of the query decides whether the result is truncated, the
+	// cursor of the URL continues it
+	qp.Offset = reqData.Offset
+	reqData.Limit = qp.Limit
+
+	if len(qp.Selects) == 0 {
+		catalog, err := loadCatalog(DB)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		qp.useCatalog(catalog)
+	}
+	reqData.Sources = qp.columnSources()
+
+	query, params := BuildQuery(qp)
+	log.Printf("query %s: %s", reqData.QueryID, query)
+
+	rows, err := DB.Query(reqData.groupQuery(query), params...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	encodeResponse(w, rows, reqData)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileQueryLang(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected string
+		Values   []interface{}
+	}{
+		{
+			Input:    "domain.arp",
+			Expected: `SELECT * FROM "domain.arp" AS domain_arp    `,
+			Values:   []interface{}{},
+		},
+		{
+			Input:    `domain.arp | where device = "eth0" and ip_address << 10.0.0.0/8 | link standard | select ip_address, standard.hostname | sort ip_address`,
+			Expected: `SELECT domain_arp.ip_address AS "domain.arp.ip_address", standard.hostname AS "standard.hostname" FROM "domain.arp" AS domain_arp INNER JOIN "standard" AS standard ON domain_arp.standard_id = standard.id WHERE domain_arp.device = $1 AND domain_arp.ip_address << $2 ORDER BY domain_arp.ip_address ASC `,
+			Values:   []interface{}{"eth0", "10.0.0.0/8"},
+		},
+		{
+			Input: `domain.packages
+                    | where name istartswith 'lib' and version != "1.0"
+                    | link left domain.arp on domain.packages.standard_id = domain.arp.standard_id
+                    | sort name desc, domain.arp.device
+                    | limit 5`,
+			Expected: `SELECT * FROM "domain.packages" AS domain_packages LEFT JOIN "domain.arp" AS domain_arp ON domain_packages.standard_id = domain_arp.standard_id WHERE domain_packages.name ILIKE $1 || '%' AND domain_packages.version != $2 ORDER BY domain_packages.name DESC, domain_arp.device ASC LIMIT 5`,
+			Values:   []interface{}{"lib", "1.0"},
+		},
+		{
+			Input:    `domain.arp | where device = 'it\'s'`,
+			Expected: `SELECT * FROM "domain.arp" AS domain_arp  WHERE domain_arp.device = $1  `,
+			Values:   []interface{}{"it's"},
+		},
+	}
+
+	for testNum, testCase := range testCases {
+		qp, err := CompileQueryLang(testCase.Input)
+		if err != nil {
+			t.Errorf("test number %d: unexpected error %v", testNum+1, err)
+			continue
+		}
+		query, values := BuildQuery(qp)
+		if query != testCase.Expected {
+			t.Errorf("test number %d: expected %s but got %s", testNum+1, testCase.Expected, query)
+		}
+		if !reflect.DeepEqual(values, testCase.Values) {
+			t.Errorf("test number %d: expected values %v but got %v", testNum+1, testCase.Values, values)
+		}
+	}
+}
+
+func TestCompileQueryLangErrors(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Line   int
+		Column int
+	}{
+		{Input: "", Line: 1, Column: 1},
+		{Input: "domain.arp | filter device = eth0", Line: 1, Column: 14},
+		{Input: "domain.arp | where device == eth0", Line: 1, Column: 27},
+		{Input: "domain.arp | where device sounds_like eth0", Line: 1, Column: 27},
+		{Input: "domain.arp\n| where device = \"eth0", Line: 2, Column: 18},
+		{Input: "domain.arp\n| limit ten", Line: 2, Column: 9},
+		{Input: "domain.arp | select device ip_address", Line: 1, Column: 28},
+		{Input: "domain.arp | link standard on device", Line: 1, Column: 37},
+	}
+
+	for testNum, testCase := range testCases {
+		_, err := CompileQueryLang(testCase.Input)
+		langErr, ok := err.(*QueryLangError)
+		if !ok {
+			t.Errorf("test number %d: expected a QueryLangError but got %v", testNum+1, err)
+			continue
+		}
+		if langErr.Line != testCase.Line || langErr.Column != testCase.Column {
+			t.Errorf("test number %d: expected line %d column %d but got %v", testNum+1, testCase.Line, testCase.Column, langErr)
+		}
+	}
+}
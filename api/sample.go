@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const maxSampleRows = 100000
+
+// Sampling methods, system and bernoulli map onto TABLESAMPLE
+var sampleMethods = map[string]string{
+	"system":    "SYSTEM",
+	"bernoulli": "BERNOULLI",
+	"rows":      "",
+}
+
+// SampleSpec is a random sample of the main node. System and bernoulli
+// sample a percentage of the main node before filters and links, rows takes
+// a number of random rows of the result. A seed makes the sample repeatable.
+type SampleSpec struct {
+	Method  string
+	Percent float64
+	Rows    int
+	Seed    string
+}
+
+// parseSample parses sample=<system|bernoulli>:<percentage>[:<seed>] or
+// sample=rows:<number of rows>[:<seed>]. It returns nil when no sample is requested.
+func parseSample(sample string) (*SampleSpec, error) {
+	if sample == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(sample, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("malformed sample parameter: %s", sample)
+	}
+
+	spec := &SampleSpec{Method: strings.ToLower(parts[0])}
+	if _, ok := sampleMethods[spec.Method]; !ok {
+		return nil, fmt.Errorf("invalid sample method: %s. Only system, bernoulli or rows is allowed", parts[0])
+	}
+
+	if spec.Method == "rows" {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 || n > maxSampleRows {
+			return nil, fmt.Errorf("invalid sample rows: %s. Allowed is 1 up to %d", parts[1], maxSampleRows)
+		}
+		spec.Rows = n
+	} else {
+		percent, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid sample percentage: %s. Allowed is more than 0 up to 100", parts[1])
+		}
+		spec.Percent = percent
+	}
+
+	if len(parts) == 3 {
+		if _, err := strconv.ParseInt(parts[2], 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid sample seed: %s", parts[2])
+		}
+		spec.Seed = parts[2]
+	}
+	return spec, nil
+}
+
+// TableSample returns the TABLESAMPLE clause for the main node, empty for rows
+func (s *SampleSpec) TableSample() string {
+	if s.Method == "rows" {
+		return ""
+	}
+	clause := fmt.Sprintf("TABLESAMPLE %s (%s)", sampleMethods[s.Method], strconv.FormatFloat(s.Percent, 'f', -1, 64))
+	if s.Seed != "" {
+		clause += fmt.Sprintf(" REPEATABLE (%s)", s.Seed)
+	}
+	return clause
+}
+
+// Order returns the random order of a rows sample. With a seed the rows of the
+// main node are ordered by a hash of their location and the seed, so the
+// sample is repeatable without setting the seed of the session. The locations
+// of the joined rows break the ties between the rows of one main row. A
+// location changes when a row is updated or the table is rewritten, so the
+// seed only repeats the sample as long as the tables are unchanged.
+func (s *SampleSpec) Order(mainAlias string, joinAliases []string) string {
+	if s.Seed == "" {
+		return "random()"
+	}
+	parts := []string{fmt.Sprintf("md5(%s.ctid::text || '%s')", mainAlias, s.Seed)}
+	for _, alias := range joinAliases {
+		parts = append(parts, alias+".ctid")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestParseSample(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected *SampleSpec
+		Err      bool
+	}{
+		{Input: "", Expected: nil},
+		{Input: "system:10", Expected: &SampleSpec{Method: "system", Percent: 10}},
+		{Input: "BERNOULLI:0.5:42", Expected: &SampleSpec{Method: "bernoulli", Percent: 0.5, Seed: "42"}},
+		{Input: "rows:100", Expected: &SampleSpec{Method: "rows", Rows: 100}},
+		{Input: "rows:100:7", Expected: &SampleSpec{Method: "rows", Rows: 100, Seed: "7"}},
+		{Input: "system", Err: true},
+		{Input: "system:0", Err: true},
+		{Input: "bernoulli:101", Err: true},
+		{Input: "rows:0", Err: true},
+		{Input: "rows:ten", Err: true},
+		{Input: "system:10:seed", Err: true},
+		{Input: "random:10", Err: true},
+		{Input: "system:10:1:2", Err: true},
+	}
+
+	for i, tc := range testCases {
+		spec, err := parseSample(tc.Input)
+		if (err != nil) != tc.Err {
+			t.Errorf("test number %d: expected error %v, got %v", i+1, tc.Err, err)
+			continue
+		}
+		if tc.Err {
+			continue
+		}
+		if (spec == nil) != (tc.Expected == nil) || (spec != nil && *spec != *tc.Expected) {
+			t.Errorf("test number %d: expected %v, got %v", i+1, tc.Expected, spec)
+		}
+	}
+}
+
+func TestSampleQuery(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected []string
+		Err      bool
+	}{
+		{
+			Input:    "dn=domain.arp&link=domain.arp.device_id:standard.id&filter=match:domain.arp.device:eth0&sample=bernoulli:5:42&limit=100",
+			Expected: []string{`FROM "domain.arp" AS domain_arp TABLESAMPLE BERNOULLI (5) REPEATABLE (42) INNER JOIN`, "LIMIT 100"},
+		},
+		{
+			Input:    "dn=domain.arp&sample=system:12.5",
+			Expected: []string{`FROM "domain.arp" AS domain_arp TABLESAMPLE SYSTEM (12.5) `},
+		},
+		{
+			Input:    "dn=domain.arp&filter=match:domain.arp.device:eth0&sample=rows:50",
+			Expected: []string{"WHERE domain_arp.device = $1 ORDER BY random() LIMIT 50"},
+		},
+		{
+			Input:    "dn=domain.arp&sample=rows:50:3&limit=10",
+			Expected: []string{"ORDER BY md5(domain_arp.ctid::text || '3') LIMIT 10"},
+		},
+		{
+			Input:    "dn=domain.arp&link=domain.arp.device_id:standard.id&sample=rows:50:3",
+			Expected: []string{"ORDER BY md5(domain_arp.ctid::text || '3'), standard.ctid LIMIT 50"},
+		},
+		{
+			Input:    "dn=domain.arp&sample=rows:50&limit=100",
+			Expected: []string{"LIMIT 50"},
+		},
+		{
+			Input: "dn=domain.arp&sample=rows:50&orderby=asc:domain.arp.device",
+			Err:   true,
+		},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.Input)
+		query, _, err := ConstructQuery(params, nil)
+		if (err != nil) != tc.Err {
+			t.Errorf("test number %d: expected error %v, got %v", i+1, tc.Err, err)
+			continue
+		}
+		if tc.Err {
+			continue
+		}
+		for _, expected := range tc.Expected {
+			if !strings.Contains(query, expected) {
+				t.Errorf("test number %d: expected %s in %s", i+1, expected, query)
+			}
+		}
+		if _, err := pg_query.Parse(query); err != nil {
+			t.Errorf("test number %d: query does not parse: %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// splitAlias splits field=<field> as <alias> into the field and its alias
+func splitAlias(s string) (string, string) {
+	index := strings.LastIndex(strings.ToLower(s), " as ")
+	if index == -1 {
+		return strings.TrimSpace(s), ""
+	}
+	return strings.TrimSpace(s[:index]), strings.TrimSpace(s[index+4:])
+}
+
+// checkAliases rejects fields with an empty field or alias around "as"
+func checkAliases(selects []string) error {
+	for _, s := range selects {
+		if field, alias := splitAlias(s); field == "" || (alias == "" && strings.Contains(strings.ToLower(s), " as ")) {
+			return fmt.Errorf("malformed field parameter: %s", s)
+		}
+	}
+	return nil
+}
+
+// useCatalog lists the fields of the main and linked nodes in qp.Columns, so
+// a query without field parameters selects them instead of *. The catalog
+// holds no __meta__ fields, so they are left out.
+func (qp *QueryParams) useCatalog(catalog []CatalogField) {
+	nodes := []string{qp.MainNode}
+	for _, join := range qp.Joins {
+		nodes = append(nodes, join.RightTable)
+	}
+
+	qp.Columns = nil
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		for _, cf := range catalog {
+			if cf.Node == node {
+				qp.Columns = append(qp.Columns, cf)
+			}
+		}
+	}
+}
+
+// buildSelectList returns the selected fields. With links every field without
+// an alias is named after its node and field, e.g. "domain.arp.device", so
+// equally named fields of different nodes don't collide.
+func buildSelectList(qp *QueryParams) string {
+	qualify := len(qp.Joins) > 0
+
+	selects := []string{}
+	for _, s := range qp.Selects {
+		field, alias := splitAlias(s)
+		if alias == "" && qualify {
+			alias = field
+		}
+
+		column := ColumnNameToSQL(field)
+		if alias != "" {
+			column += " AS " + pq.QuoteIdentifier(alias)
+		}
+		selects = append(selects, column)
+	}
+
+	if len(qp.Selects) == 0 {
+		for _, cf := range qp.Columns {
+			column := toAlias(cf.Node) + "." + pq.QuoteIdentifier(cf.Field)
+			if qualify {
+				column += " AS " + pq.QuoteIdentifier(cf.Node+"."+cf.Field)
+			}
+			selects = append(selects, column)
+		}
+	}
+
+	if len(selects) == 0 {
+		return "*"
+	}
+	return strings.Join(selects, ", ")
+}
+
+// ColumnSource is the node and field a result column is selected from
+type ColumnSource struct {
+	Node  string `json:"node"`
+	Field string `json:"field"`
+}
+
+// columnSources returns the source of every column of buildSelectList by column name
+func (qp *QueryParams) columnSources() map[string]ColumnSource {
+	qualify := len(qp.Joins) > 0
+
+	sources := map[string]ColumnSource{}
+	for _, s := range qp.Selects {
+		field, alias := splitAlias(s)
+		node, column, err := splitTableAndColumn(field)
+		if err != nil {
+			continue
+		}
+		if alias == "" {
+			alias = column
+			if qualify {
+				alias = field
+			}
+		}
+		sources[alias] = ColumnSource{Node: node, Field: column}
+	}
+
+	if len(qp.Selects) == 0 {
+		for _, cf := range qp.Columns {
+			name := cf.Field
+			if qualify {
+				name = cf.Node + "." + cf.Field
+			}
+			sources[name] = ColumnSource{Node: cf.Node, Field: cf.Field}
+		}
+	}
+	return sources
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestSelectAliases(t *testing.T) {
+	catalog := []CatalogField{
+		{Node: "domain.arp", Field: "device"},
+		{Node: "domain.arp", Field: "standard_id"},
+		{Node: "domain.packages", Field: "name"},
+		{Node: "standard", Field: "id"},
+		{Node: "standard", Field: "hostname"},
+	}
+
+	testCases := []struct {
+		Input    string
+		Expected string
+		Err      bool
+	}{
+		{
+			Input:    "dn=domain.arp",
+			Expected: `SELECT domain_arp."device", domain_arp."standard_id" FROM "domain.arp" AS domain_arp`,
+		},
+		{
+			Input:    "dn=domain.arp&link=domain.arp.standard_id:standard.id",
+			Expected: `SELECT domain_arp."device" AS "domain.arp.device", domain_arp."standard_id" AS "domain.arp.standard_id", standard."id" AS "standard.id", standard."hostname" AS "standard.hostname" FROM`,
+		},
+		{
+			Input:    "dn=domain.arp&field=domain.arp.device as dev&field=domain.arp.standard_id",
+			Expected: `SELECT domain_arp.device AS "dev", domain_arp.standard_id FROM`,
+		},
+		{
+			Input:    "dn=domain.arp&link=domain.arp.standard_id:standard.id&field=domain.arp.device AS Device&field=standard.hostname",
+			Expected: `SELECT domain_arp.device AS "Device", standard.hostname AS "standard.hostname" FROM`,
+		},
+		{Input: "dn=domain.arp&field=domain.arp.device as ", Err: true},
+		{Input: "dn=domain.arp&field= as dev", Err: true},
+	}
+
+	for i, tc := range testCases {
+		params, _ := url.ParseQuery(tc.Input)
+		query, _, err := ConstructQuery(params, catalog)
+		if (err != nil) != tc.Err {
+			t.Errorf("test number %d: expected error %v, got %v", i+1, tc.Err, err)
+			continue
+		}
+		if tc.Err {
+			continue
+		}
+		if !strings.HasPrefix(query, tc.Expected) {
+			t.Errorf("test number %d: expected %s in %s", i+1, tc.Expected, query)
+		}
+		if _, err := pg_query.Parse(query); err != nil {
+			t.Errorf("test number %d: query does not parse: %v", i+1, err)
+		}
+	}
+}
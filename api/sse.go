@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Rows per rows event, unless batchsize is given
+const defaultSSEBatchSize = 500
+
+// sseProgress is the data of the progress and complete events
+type sseProgress struct {
+	Rows      int   `json:"rows"`
+	ElapsedMS int64 `json:"elapsed_ms"`
+	// Only set on the complete event
+	Truncated *bool `json:"truncated,omitempty"`
+}
+
+// writeEvent writes a server-sent event, data is JSON and so a single line
+func writeEvent(w io.Writer, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// streamSSE writes the result as server-sent events, so a browser can render
+// it while the query runs:
+//
+//	event: columns   the schema of the columnar format
+//	event: rows      a batch of rows as arrays of their values
+//	event: progress  rows so far and elapsed time, after every batch
+//	event: complete  the final row count, elapsed time and truncated flag
+//	event: error     the message of the error that ended the result
+//
+// A batch is sent when it is full or streamFlushInterval passed. Closing the
+// event stream cancels the query, see QueryGenHandler.
+func streamSSE(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	start := requestData.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	decoders := s.JSONDecoders(requestData)
+	schemaJSON, err := json.Marshal(columnarSchema(s, requestData.Sources))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+
+	batchSize := requestData.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultSSEBatchSize
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep proxies such as nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	out := newStreamWriter(w)
+	defer out.Flush()
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(out, "columns", schemaJSON); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	progress := sseProgress{}
+	batch := []byte{}
+	pending := 0
+	lastBatch := time.Now()
+	send := func() error {
+		batch = append(batch, ']')
+		if err := writeEvent(out, "rows", batch); err != nil {
+			return err
+		}
+		progress.ElapsedMS = time.Since(start).Milliseconds()
+		progressJSON, _ := json.Marshal(progress)
+		if err := writeEvent(out, "progress", progressJSON); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		pending = 0
+		lastBatch = time.Now()
+		return out.Flush()
+	}
+
+	for s.Next() {
+		if pending == 0 {
+			batch = append(batch, '[')
+		} else {
+			batch = append(batch, ',')
+		}
+		batch = append(batch, s.JSONArray(decoders)...)
+		pending++
+		progress.Rows++
+
+		if pending == batchSize || time.Since(lastBatch) >= streamFlushInterval {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if pending > 0 {
+		if err := send(); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		writeEvent(out, "error", streamErrorJSON(err))
+		return reportedError{err}
+	}
+
+	truncated := requestData.truncated(progress.Rows)
+	progress.Truncated = &truncated
+	progress.ElapsedMS = time.Since(start).Milliseconds()
+	completeJSON, _ := json.Marshal(progress)
+	return writeEvent(out, "complete", completeJSON)
+}
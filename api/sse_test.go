@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestStreamSSE(t *testing.T) {
+	rows := [][]driver.Value{
+		{[]byte("eth0"), int64(1)},
+		{"eth1", nil},
+		{"eth2", int64(3)},
+	}
+	columns := `event: columns
+data: [{"name":"device","type":"text","node":"domain.arp","field":"device"},{"name":"flags","type":"int8"}]
+
+`
+	// elapsed_ms depends on the run time
+	elapsed := regexp.MustCompile(`"elapsed_ms":\d+`)
+
+	testCases := []struct {
+		result    fakeResult
+		limit     string
+		batchSize int
+		expected  string
+	}{
+		{
+			result: fakeResult{Columns: []string{"device", "flags"}, Types: []string{"TEXT", "INT8"}, Rows: rows},
+			limit:  "3",
+			expected: columns + `event: rows
+data: [["eth0",1],["eth1",null],["eth2",3]]
+
+event: progress
+data: {"rows":3,"elapsed_ms":0}
+
+event: complete
+data: {"rows":3,"elapsed_ms":0,"truncated":true}
+
+`,
+		},
+		{
+			result:    fakeResult{Columns: []string{"device", "flags"}, Types: []string{"TEXT", "INT8"}, Rows: rows, Err: errors.New("timeout")},
+			batchSize: 2,
+			expected: columns + `event: rows
+data: [["eth0",1],["eth1",null]]
+
+event: progress
+data: {"rows":2,"elapsed_ms":0}
+
+event: rows
+data: [["eth2",3]]
+
+event: progress
+data: {"rows":3,"elapsed_ms":0}
+
+event: error
+data: {"message":"timeout"}
+
+`,
+		},
+		{
+			result: fakeResult{Columns: []string{"device", "flags"}, Types: []string{"TEXT", "INT8"}},
+			expected: columns + `event: complete
+data: {"rows":0,"elapsed_ms":0,"truncated":false}
+
+`,
+		},
+	}
+
+	for i, tc := range testCases {
+		w := httptest.NewRecorder()
+		requestData := &RequestData{
+			Format:    "sse",
+			Limit:     tc.limit,
+			BatchSize: tc.batchSize,
+			Sources:   map[string]ColumnSource{"device": {Node: "domain.arp", Field: "device"}},
+		}
+		encodeResponse(w, queryFake(t, tc.result), requestData)
+
+		if body := elapsed.ReplaceAllString(w.Body.String(), `"elapsed_ms":0`); body != tc.expected {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.expected, body)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf("test number %d: unexpected content type %s", i, contentType)
+		}
+		if !w.Flushed {
+			t.Errorf("test number %d: expected the events to be flushed", i)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const subQueryAlias = "static_query"
+
+// URL parameters that turn a static query into a subquery
+var subQueryParams = []string{"field", "filter", "orderby", "limit", "cursor"}
+
+// SubQueryColumn is an output column of a static query
+type SubQueryColumn struct {
+	Name   string
+	DBType string
+}
+
+func wantsSubQuery(params url.Values) bool {
+	for _, key := range subQueryParams {
+		if _, ok := params[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// trimQuery removes trailing whitespace and semicolons so the query can be embedded
+func trimQuery(query string) string {
+	return strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+}
+
+// Queryer runs a query on the database or in a transaction
+type Queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// subQueryColumns runs the query without returning rows to learn its output columns
+func subQueryColumns(db Queryer, query string, args []interface{}) ([]SubQueryColumn, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM (%s) AS %s LIMIT 0", trimQuery(query), subQueryAlias), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]SubQueryColumn, len(columnTypes))
+	for i, ct := range columnTypes {
+		columns[i] = SubQueryColumn{Name: ct.Name(), DBType: ct.DatabaseTypeName()}
+	}
+	return columns, nil
+}
+
+// columnOperatorType maps a database type name onto the keys of AllowedOperators.
+// Types without operators return an empty string.
+func columnOperatorType(dbType string) string {
+	dbType = strings.ToUpper(dbType)
+	if strings.HasPrefix(dbType, "_") {
+		return "array"
+	}
+
+	switch dbType {
+	// Domains such as information_schema.sql_identifier have no name in the driver
+	case "", "TEXT", "VARCHAR", "BPCHAR", "CHAR", "NAME":
+		return "text"
+	case "CIDR":
+		return "cidr"
+	case "INET":
+		return "inet"
+	case "INT2", "INT4", "INT8", "NUMERIC", "FLOAT4", "FLOAT8", "OID":
+		return "int"
+	case "UUID":
+		return "uuid"
+	case "DATE", "TIME", "TIMETZ", "TIMESTAMP", "TIMESTAMPTZ":
+		return "timezone"
+	}
+	return ""
+}
+
+func isAllowedOperator(operatorType, operator string) bool {
+	for _, allowed := range AllowedOperators[operatorType] {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// ConstructSubQuery wraps a static query and applies the field, filter,
+// orderby and limit parameters of ParseQueryParams to its output columns.
+// Filter placeholders are numbered after the arguments of the static query.
+func ConstructSubQuery(base string, args []interface{}, columns []SubQueryColumn, params url.Values) (string, []interface{}, error) {
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(qp.Joins) > 0 {
+		return "", nil, fmt.Errorf("link is not supported on static queries")
+	}
+	if len(qp.Lists) > 0 {
+		return "", nil, fmt.Errorf("value lists are only supported on /api/gen")
+	}
+
+	columnTypes := make(map[string]string, len(columns))
+	for _, column := range columns {
+		columnTypes[column.Name] = column.DBType
+	}
+
+	columnSQL := func(name string) (string, error) {
+		if _, ok := columnTypes[name]; !ok {
+			return "", fmt.Errorf("unknown column: %s", name)
+		}
+		return subQueryAlias + "." + pq.QuoteIdentifier(name), nil
+	}
+
+	// Building SELECT clause
+	selectClause := "SELECT *"
+	if len(qp.Selects) > 0 {
+		selects := make([]string, len(qp.Selects))
+		for i, s := range qp.Selects {
+			field, alias := splitAlias(s)
+			if selects[i], err = columnSQL(field); err != nil {
+				return "", nil, err
+			}
+			if alias != "" {
+				selects[i] += " AS " + pq.QuoteIdentifier(alias)
+			}
+		}
+		selectClause = "SELECT " + strings.Join(selects, ", ")
+	}
+
+	// Building WHERE clause
+	values := append([]interface{}{}, args...)
+	whereClauses := []string{}
+	for _, filter := range qp.Filters {
+		column, err := columnSQL(filter.DNPath)
+		if err != nil {
+			return "", nil, err
+		}
+
+		operatorType := columnOperatorType(columnTypes[filter.DNPath])
+		if !isAllowedOperator(operatorType, filter.Name) {
+			return "", nil, fmt.Errorf("operator %s is not allowed for column %s of type %s", filter.Name, filter.DNPath, strings.ToLower(columnTypes[filter.DNPath]))
+		}
+
+		values = append(values, filter.Value)
+		filter.Placeholder = fmt.Sprintf("$%d", len(values))
+		whereClauses = append(whereClauses, fmt.Sprintf("%s %s", column, fmt.Sprintf(filter.Operator, filter.Placeholder)))
+	}
+
+	query := fmt.Sprintf("%s FROM (%s) AS %s", selectClause, trimQuery(base), subQueryAlias)
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	// Building orderby
+	if len(qp.Order) > 0 {
+		orderParts := make([]string, len(qp.Order))
+		for i, order := range qp.Order {
+			column, err := columnSQL(order.Field)
+			if err != nil {
+				return "", nil, err
+			}
+			orderParts[i] = fmt.Sprintf("%s %s", column, order.Direction)
+		}
+		query += " ORDER BY " + strings.Join(orderParts, ", ")
+	}
+
+	if qp.Limit != "" {
+		query += " LIMIT " + qp.Limit
+	}
+	if qp.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", qp.Offset)
+	}
+
+	return query, values, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConstructSubQuery(t *testing.T) {
+	columns := []SubQueryColumn{
+		{Name: "device", DBType: "TEXT"},
+		{Name: "ip_address", DBType: "INET"},
+		{Name: "device_id", DBType: "UUID"},
+	}
+
+	testCases := []struct {
+		Input    string
+		Args     []interface{}
+		Expected string
+		Values   []interface{}
+		Err      bool
+	}{
+		{
+			Input:    "limit=10",
+			Expected: `SELECT * FROM (SELECT * FROM "domain.arp") AS static_query LIMIT 10`,
+			Values:   []interface{}{},
+		},
+		{
+			Input:    "limit=10&orderby=asc:device&cursor=" + encodeCursor(20),
+			Expected: `SELECT * FROM (SELECT * FROM "domain.arp") AS static_query ORDER BY static_query."device" ASC LIMIT 10 OFFSET 20`,
+			Values:   []interface{}{},
+		},
+		{
+			Input:    "field=device&field=ip_address&orderby=desc:device",
+			Expected: `SELECT static_query."device", static_query."ip_address" FROM (SELECT * FROM "domain.arp") AS static_query ORDER BY static_query."device" DESC`,
+			Values:   []interface{}{},
+		},
+		{
+			Input:    "filter=match:device:eth0&filter=ip_contains:ip_address:10.0.0.0/8",
+			Expected: `SELECT * FROM (SELECT * FROM "domain.arp") AS static_query WHERE static_query."device" = $1 AND static_query."ip_address" << $2`,
+			Values:   []interface{}{"eth0", "10.0.0.0/8"},
+		},
+		{
+			Input:    "filter=match:device:eth0",
+			Args:     []interface{}{"domain.arp"},
+			Expected: `SELECT * FROM (SELECT * FROM "domain.arp") AS static_query WHERE static_query."device" = $2`,
+			Values:   []interface{}{"domain.arp", "eth0"},
+		},
+		{
+			Input: "filter=startswith:device_id:abc",
+			Err:   true,
+		},
+		{
+			Input: "field=hostname",
+			Err:   true,
+		},
+		{
+			Input: "link=domain.arp.device_id:standard.id",
+			Err:   true,
+		},
+		{
+			Input: "orderby=asc:(select 1)",
+			Err:   true,
+		},
+	}
+
+	for testNum, testCase := range testCases {
+		params, _ := url.ParseQuery(testCase.Input)
+		query, values, err := ConstructSubQuery(`SELECT * FROM "domain.arp";`, testCase.Args, columns, params)
+		if testCase.Err {
+			if err == nil {
+				t.Errorf("test number %d: expected an error for input %s", testNum+1, testCase.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test number %d: unexpected error %v", testNum+1, err)
+			continue
+		}
+		if query != testCase.Expected {
+			t.Errorf("test number %d: expected %s but got %s", testNum+1, testCase.Expected, query)
+		}
+		if !reflect.DeepEqual(values, testCase.Values) {
+			t.Errorf("test number %d: expected values %v but got %v", testNum+1, testCase.Values, values)
+		}
+	}
+}
+
+func TestConstructQueryOrderColumn(t *testing.T) {
+	params, _ := url.ParseQuery("dn=domain.arp&field=domain.arp.device as interface&orderby=asc:(select 1)&orderby=desc:interface")
+	query, _, err := ConstructQuery(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `ORDER BY "(select 1)" ASC, "interface" DESC`
+	if !strings.Contains(query, expected) {
+		t.Errorf("expected %s in %s", expected, query)
+	}
+}
+
+func TestColumnOperatorType(t *testing.T) {
+	testCases := map[string]string{
+		"TEXT":  "text",
+		"INET":  "inet",
+		"INT4":  "int",
+		"_TEXT": "array",
+		"uuid":  "uuid",
+		"BOOL":  "",
+	}
+
+	for input, expected := range testCases {
+		if result := columnOperatorType(input); result != expected {
+			t.Errorf("For input %s: expected %s but got %s", input, expected, result)
+		}
+	}
+}
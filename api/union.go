@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// UnionSelector picks the fields that are combined into one value column
+type UnionSelector struct {
+	Type string
+	Name string
+}
+
+func parseUnionSelector(params url.Values) (UnionSelector, error) {
+	selector := UnionSelector{
+		Type: strings.ToLower(params.Get("type")),
+		Name: params.Get("name"),
+	}
+	if selector.Type == "" && selector.Name == "" {
+		return selector, fmt.Errorf("union expects a type or name selector")
+	}
+	return selector, nil
+}
+
+func (s UnionSelector) matches(cf CatalogField) bool {
+	if s.Type != "" && strings.ToLower(cf.FieldType) != s.Type {
+		return false
+	}
+	if s.Name != "" && cf.Field != s.Name {
+		return false
+	}
+	return true
+}
+
+// ConstructUnionQuery builds a UNION ALL over every matching field with
+// node and field provenance columns. Fields of different types are unified as text.
+func ConstructUnionQuery(catalog []CatalogField, selector UnionSelector) (string, error) {
+	matched := []CatalogField{}
+	types := map[string]struct{}{}
+	for _, cf := range catalog {
+		if selector.matches(cf) {
+			matched = append(matched, cf)
+			types[strings.ToLower(cf.FieldType)] = struct{}{}
+		}
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("no fields match the union selector")
+	}
+
+	parts := make([]string, len(matched))
+	for i, cf := range matched {
+		value := pq.QuoteIdentifier(cf.Field)
+		if len(types) > 1 {
+			value += "::text"
+		}
+		parts[i] = fmt.Sprintf("SELECT %s AS node, %s AS field, %s AS value FROM %s",
+			pq.QuoteLiteral(cf.Node), pq.QuoteLiteral(cf.Field), value, pq.QuoteIdentifier(cf.Node))
+	}
+	return strings.Join(parts, " UNION ALL "), nil
+}
+
+func UnionHandler(w http.ResponseWriter, r *http.Request) {
+	reqData, err := parseInputGen(r)
+	if err == nil {
+		err = checkGenOnlyFormat(reqData.Format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	urlQueryParams := r.URL.Query()
+	selector, err := parseUnionSelector(urlQueryParams)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	catalog, err := loadCatalog(DB)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	query, err := ConstructUnionQuery(catalog, selector)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	var params []interface{}
+	if wantsSubQuery(urlQueryParams) {
+		columns, err := subQueryColumns(DB, query, params)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		query, params, err = ConstructSubQuery(query, params, columns, urlQueryParams)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	log.Printf("query %s: union %s", reqData.QueryID, query)
+
+	rows, err := DB.Query(reqData.groupQuery(query), params...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	encodeResponse(w, rows, reqData)
+}
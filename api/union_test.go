@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConstructUnionQuery(t *testing.T) {
+	catalog := []CatalogField{
+		{Node: "domain.arp", Field: "ip_address", FieldType: "inet"},
+		{Node: "domain.arp", Field: "device", FieldType: "text"},
+		{Node: "domain.address", Field: "value", FieldType: "inet"},
+		{Node: "domain.hostfile", Field: "ip_address", FieldType: "text"},
+	}
+
+	testCases := []struct {
+		Selector UnionSelector
+		Expected string
+	}{
+		{
+			Selector: UnionSelector{Type: "inet"},
+			Expected: `SELECT 'domain.arp' AS node, 'ip_address' AS field, "ip_address" AS value FROM "domain.arp" UNION ALL SELECT 'domain.address' AS node, 'value' AS field, "value" AS value FROM "domain.address"`,
+		},
+		{
+			Selector: UnionSelector{Name: "ip_address"},
+			Expected: `SELECT 'domain.arp' AS node, 'ip_address' AS field, "ip_address"::text AS value FROM "domain.arp" UNION ALL SELECT 'domain.hostfile' AS node, 'ip_address' AS field, "ip_address"::text AS value FROM "domain.hostfile"`,
+		},
+		{
+			Selector: UnionSelector{Type: "inet", Name: "value"},
+			Expected: `SELECT 'domain.address' AS node, 'value' AS field, "value" AS value FROM "domain.address"`,
+		},
+	}
+
+	for testNum, testCase := range testCases {
+		query, err := ConstructUnionQuery(catalog, testCase.Selector)
+		if err != nil {
+			t.Errorf("test number %d: unexpected error %v", testNum+1, err)
+			continue
+		}
+		if query != testCase.Expected {
+			t.Errorf("test number %d: expected %s but got %s", testNum+1, testCase.Expected, query)
+		}
+	}
+
+	if _, err := ConstructUnionQuery(catalog, UnionSelector{Type: "macaddr"}); err == nil {
+		t.Errorf("expected an error when no field matches")
+	}
+}
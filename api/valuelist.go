@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxValueListBytes  = 32 << 20
+	maxValueListSize   = 100000
+	maxReportedInvalid = 20
+)
+
+// Filter operators on uploaded value lists, true when the list excludes rows
+var listOperators = map[string]bool{
+	"in_list":    false,
+	"notin_list": true,
+}
+
+// ListFilter limits a field to the values of an uploaded list, which is
+// loaded into the temporary table Table for the duration of the request.
+type ListFilter struct {
+	Negate bool
+	DNPath string
+	List   string
+	Table  string
+}
+
+// parseListFilter parses the parts of filter=in_list:<field>:<list name>
+func parseListFilter(parts []string, index int) (ListFilter, bool) {
+	negate, ok := listOperators[strings.ToLower(parts[0])]
+	if !ok {
+		return ListFilter{}, false
+	}
+	return ListFilter{
+		Negate: negate,
+		DNPath: parts[1],
+		List:   parts[2],
+		Table:  fmt.Sprintf("value_list_%d", index+1),
+	}, true
+}
+
+// Condition semi-joins the field against the list table, or anti-joins it for notin_list
+func (l ListFilter) Condition() string {
+	condition := fmt.Sprintf("EXISTS (SELECT 1 FROM pg_temp.%s AS value_list WHERE value_list.value = %s)",
+		pq.QuoteIdentifier(l.Table), ColumnNameToSQL(l.DNPath))
+	if l.Negate {
+		return "NOT " + condition
+	}
+	return condition
+}
+
+// ValueList holds the uploaded values of a list with their position in the
+// upload, the line of a file or the index in a JSON array.
+type ValueList struct {
+	Values    []string
+	Positions []int
+}
+
+func (vl *ValueList) add(value string, position int) error {
+	if len(vl.Values) == maxValueListSize {
+		return fmt.Errorf("a value list holds at most %d values", maxValueListSize)
+	}
+	vl.Values = append(vl.Values, value)
+	vl.Positions = append(vl.Positions, position)
+	return nil
+}
+
+// parseValueLists reads the lists from a multipart upload with one file per
+// list and one value per line, or from a JSON object of list name to values.
+func parseValueLists(r *http.Request) (map[string]*ValueList, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("value lists are uploaded as multipart/form-data or application/json")
+	}
+
+	lists := map[string]*ValueList{}
+	list := func(name string) *ValueList {
+		if lists[name] == nil {
+			lists[name] = &ValueList{}
+		}
+		return lists[name]
+	}
+
+	switch mediaType {
+	case "application/json":
+		decoder := json.NewDecoder(io.LimitReader(r.Body, maxValueListBytes))
+		decoder.UseNumber()
+		uploaded := map[string][]interface{}{}
+		if err := decoder.Decode(&uploaded); err != nil {
+			return nil, fmt.Errorf("invalid value lists: %v", err)
+		}
+		for name, values := range uploaded {
+			vl := list(name)
+			for i, value := range values {
+				switch v := value.(type) {
+				case string:
+					err = vl.add(v, i+1)
+				case json.Number:
+					err = vl.add(v.String(), i+1)
+				default:
+					return nil, fmt.Errorf("value %d of list %s is not a string or number", i+1, name)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	case "multipart/form-data":
+		r.Body = http.MaxBytesReader(nil, r.Body, maxValueListBytes)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			vl := list(part.FormName())
+			scanner := bufio.NewScanner(part)
+			scanner.Buffer(make([]byte, 64*1024), 1<<20)
+			line := 0
+			for scanner.Scan() {
+				line++
+				value := strings.TrimSpace(scanner.Text())
+				if value == "" {
+					continue
+				}
+				if err := vl.add(value, line); err != nil {
+					return nil, err
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("value lists are uploaded as multipart/form-data or application/json, got %s", mediaType)
+	}
+	return lists, nil
+}
+
+// ValueListError reports the values of a list that are not valid for the type of the field
+type ValueListError struct {
+	List      string
+	Type      string
+	Values    []string
+	Positions []int
+}
+
+func (e *ValueListError) Error() string {
+	reported := []string{}
+	for i, value := range e.Values {
+		if i == maxReportedInvalid {
+			reported = append(reported, fmt.Sprintf("and %d more", len(e.Values)-maxReportedInvalid))
+			break
+		}
+		reported = append(reported, fmt.Sprintf("%d: %q", e.Positions[i], value))
+	}
+	return fmt.Sprintf("list %s has %d invalid values for type %s: %s", e.List, len(e.Values), e.Type, strings.Join(reported, ", "))
+}
+
+// checkValueLists makes sure every list filter has an uploaded list
+func checkValueLists(filters []ListFilter, lists map[string]*ValueList) error {
+	for _, filter := range filters {
+		if _, ok := lists[filter.List]; !ok {
+			return fmt.Errorf("value list %s is not uploaded", filter.List)
+		}
+	}
+	return nil
+}
+
+// loadValueLists creates a temporary table per list filter, typed as the
+// filtered field. The values are checked with pg_input_is_valid first, so an
+// invalid value is reported as *ValueListError instead of being dropped.
+func loadValueLists(tx *sql.Tx, filters []ListFilter, lists map[string]*ValueList) error {
+	for _, filter := range filters {
+		vl := lists[filter.List]
+
+		node, field, err := splitTableAndColumn(filter.DNPath)
+		if err != nil {
+			return err
+		}
+		fieldType, err := loadFieldType(tx, node, field)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT t.n FROM unnest($1::text[]) WITH ORDINALITY AS t(v, n)
+                               WHERE NOT pg_input_is_valid(t.v, $2) ORDER BY t.n`, pq.Array(vl.Values), fieldType)
+		if err != nil {
+			return err
+		}
+		invalid := &ValueListError{List: filter.List, Type: fieldType}
+		for rows.Next() {
+			var n int
+			if err := rows.Scan(&n); err != nil {
+				rows.Close()
+				return err
+			}
+			invalid.Values = append(invalid.Values, vl.Values[n-1])
+			invalid.Positions = append(invalid.Positions, vl.Positions[n-1])
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(invalid.Values) > 0 {
+			return invalid
+		}
+
+		table := pq.QuoteIdentifier(filter.Table)
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (value %s) ON COMMIT DROP", table, fieldType)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO pg_temp.%s SELECT DISTINCT t.v::%s FROM unnest($1::text[]) AS t(v)",
+			table, fieldType), pq.Array(vl.Values)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("ANALYZE pg_temp." + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+func TestListFilterQuery(t *testing.T) {
+	params, _ := url.ParseQuery("dn=domain.arp&filter=match:domain.arp.device:eth0&filter=in_list:domain.arp.ip_address:ips&filter=notin_list:domain.arp.hw_address:macs&filter=match:domain.arp.flags:0x2")
+	qp, err := ParseQueryParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLists := []ListFilter{
+		{Negate: false, DNPath: "domain.arp.ip_address", List: "ips", Table: "value_list_1"},
+		{Negate: true, DNPath: "domain.arp.hw_address", List: "macs", Table: "value_list_2"},
+	}
+	if !reflect.DeepEqual(qp.Lists, expectedLists) {
+		t.Errorf("expected lists %v, got %v", expectedLists, qp.Lists)
+	}
+
+	query, values := BuildQuery(qp)
+	expected := `WHERE domain_arp.device = $1 AND domain_arp.flags = $2 AND EXISTS (SELECT 1 FROM pg_temp."value_list_1" AS value_list WHERE value_list.value = domain_arp.ip_address) AND NOT EXISTS (SELECT 1 FROM pg_temp."value_list_2" AS value_list WHERE value_list.value = domain_arp.hw_address)`
+	if !strings.Contains(query, expected) {
+		t.Errorf("expected %s in %s", expected, query)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"eth0", "0x2"}) {
+		t.Errorf("unexpected values %v", values)
+	}
+	if _, err := pg_query.Parse(query); err != nil {
+		t.Errorf("query does not parse: %v", err)
+	}
+}
+
+func TestParseValueLists(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/gen/", strings.NewReader(`{"ips": ["10.0.0.1", "10.0.0.2"], "ids": [1, 2.5]}`))
+	r.Header.Set("Content-Type", "application/json")
+	lists, err := parseValueLists(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lists["ips"], &ValueList{Values: []string{"10.0.0.1", "10.0.0.2"}, Positions: []int{1, 2}}) {
+		t.Errorf("unexpected ips list %v", lists["ips"])
+	}
+	if !reflect.DeepEqual(lists["ids"].Values, []string{"1", "2.5"}) {
+		t.Errorf("unexpected ids list %v", lists["ids"])
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("ips", "ips.txt")
+	part.Write([]byte("10.0.0.1\n\n  10.0.0.3 \r\n10.0.0.4"))
+	writer.Close()
+
+	r = httptest.NewRequest("POST", "/api/gen/", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	lists, err = parseValueLists(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lists["ips"], &ValueList{Values: []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"}, Positions: []int{1, 3, 4}}) {
+		t.Errorf("unexpected uploaded list %v", lists["ips"])
+	}
+
+	testCases := []struct {
+		ContentType string
+		Body        string
+	}{
+		{ContentType: "application/json", Body: `{"ips": [null]}`},
+		{ContentType: "application/json", Body: `["10.0.0.1"]`},
+		{ContentType: "text/plain", Body: "10.0.0.1"},
+		{ContentType: "", Body: ""},
+	}
+	for i, tc := range testCases {
+		r := httptest.NewRequest("POST", "/api/gen/", strings.NewReader(tc.Body))
+		r.Header.Set("Content-Type", tc.ContentType)
+		if _, err := parseValueLists(r); err == nil {
+			t.Errorf("test number %d: expected an error", i+1)
+		}
+	}
+}
+
+func TestValueListErrors(t *testing.T) {
+	lists := map[string]*ValueList{"ips": {}}
+	if err := checkValueLists([]ListFilter{{List: "ips"}}, lists); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := checkValueLists([]ListFilter{{List: "ips"}, {List: "macs"}}, lists); err == nil {
+		t.Errorf("expected an error for a list that is not uploaded")
+	}
+
+	err := &ValueListError{List: "ips", Type: "inet", Values: []string{"foo", "10.0.0.300"}, Positions: []int{3, 9}}
+	expected := `list ips has 2 invalid values for type inet: 3: "foo", 9: "10.0.0.300"`
+	if err.Error() != expected {
+		t.Errorf("expected %s, got %s", expected, err.Error())
+	}
+
+	for i := 0; i < maxReportedInvalid+3; i++ {
+		err.Values = append(err.Values, "x")
+		err.Positions = append(err.Positions, 10+i)
+	}
+	if !strings.HasSuffix(err.Error(), ", and 5 more") {
+		t.Errorf("expected the report to be capped, got %s", err.Error())
+	}
+}
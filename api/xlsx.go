@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/xuri/excelize/v2"
+)
+
+// A workbook with more sheets is hard to use, ask for a coarser groupby instead
+const maxXLSXSheets = 1000
+
+// xlsxStyles are the number formats of the typed cells
+type xlsxStyles struct {
+	header   int
+	date     int
+	time     int
+	datetime int
+}
+
+func newXLSXStyles(f *excelize.File) (*xlsxStyles, error) {
+	styles := &xlsxStyles{}
+	var err error
+	if styles.header, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err != nil {
+		return nil, err
+	}
+	if styles.date, err = f.NewStyle(&excelize.Style{NumFmt: 14}); err != nil {
+		return nil, err
+	}
+	if styles.time, err = f.NewStyle(&excelize.Style{NumFmt: 21}); err != nil {
+		return nil, err
+	}
+	if styles.datetime, err = f.NewStyle(&excelize.Style{NumFmt: 22}); err != nil {
+		return nil, err
+	}
+	return styles, nil
+}
+
+// xlsxValue converts a value as scanned from lib/pq into a typed cell.
+// Numbers and dates become numeric cells, arrays a text of their elements
+// and other types, such as cidr or uuid, their text.
+func xlsxValue(dbType string, v interface{}, styles *xlsxStyles) interface{} {
+	dbType = strings.ToUpper(dbType)
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		switch dbType {
+		case "DATE":
+			return excelize.Cell{StyleID: styles.date, Value: value}
+		case "TIME", "TIMETZ":
+			midnight := time.Date(value.Year(), value.Month(), value.Day(), 0, 0, 0, 0, value.Location())
+			return excelize.Cell{StyleID: styles.time, Value: value.Sub(midnight).Hours() / 24}
+		}
+		// Excel has no time zones, timestamps are written in UTC
+		return excelize.Cell{StyleID: styles.datetime, Value: value.UTC()}
+	case []byte:
+		if dbType == "NUMERIC" {
+			if f, err := strconv.ParseFloat(string(value), 64); err == nil {
+				return f
+			}
+		}
+		if strings.HasPrefix(dbType, "_") {
+			elements := []sql.NullString{}
+			if err := (pq.GenericArray{A: &elements}).Scan(value); err == nil {
+				texts := make([]string, len(elements))
+				for i, element := range elements {
+					texts[i] = element.String
+				}
+				return strings.Join(texts, ", ")
+			}
+		}
+		return string(value)
+	}
+	return v
+}
+
+// sheetName makes name a valid sheet name, which is unique among used
+// regardless of case as Excel requires.
+func sheetName(name string, used map[string]bool) string {
+	name = strings.Trim(strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '_'
+		}
+		return r
+	}, name), "'")
+	if name == "" {
+		name = "(empty)"
+	}
+
+	truncate := func(s string, n int) string {
+		for utf8.RuneCountInString(s) > n {
+			_, size := utf8.DecodeLastRuneInString(s)
+			s = s[:len(s)-size]
+		}
+		return s
+	}
+
+	unique := truncate(name, excelize.MaxSheetNameLength)
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		unique = truncate(name, excelize.MaxSheetNameLength-len(suffix)) + suffix
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// xlsxWorkbook writes the rows one sheet after the other, every sheet with a
+// frozen header row and a table with auto-filter over its rows.
+type xlsxWorkbook struct {
+	f      *excelize.File
+	styles *xlsxStyles
+	header []interface{}
+	used   map[string]bool
+	sw     *excelize.StreamWriter
+	sheets int
+	row    int
+	// Name of the open sheet before it was made unique, for its continuation sheets
+	name string
+}
+
+func newXLSXWorkbook(cols []string) (*xlsxWorkbook, error) {
+	f := excelize.NewFile()
+	styles, err := newXLSXStyles(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Table headers must be unique
+	names := map[string]bool{}
+	header := make([]interface{}, len(cols))
+	for i, col := range cols {
+		base := col
+		if base == "" {
+			base = fmt.Sprintf("column %d", i+1)
+		}
+		name := base
+		for n := 2; names[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)", base, n)
+		}
+		names[strings.ToLower(name)] = true
+		header[i] = excelize.Cell{StyleID: styles.header, Value: name}
+	}
+
+	return &xlsxWorkbook{f: f, styles: styles, header: header, used: map[string]bool{}}, nil
+}
+
+// open ends the open sheet and starts a sheet with the header row
+func (wb *xlsxWorkbook) open(name string) error {
+	if err := wb.flush(); err != nil {
+		return err
+	}
+	if wb.sheets == maxXLSXSheets {
+		return fmt.Errorf("the result needs more than %d sheets, use fewer groupby fields", maxXLSXSheets)
+	}
+	wb.sheets++
+	wb.name = name
+
+	sheet := sheetName(name, wb.used)
+	if wb.sheets == 1 {
+		if err := wb.f.SetSheetName(wb.f.GetSheetName(0), sheet); err != nil {
+			return err
+		}
+	} else if _, err := wb.f.NewSheet(sheet); err != nil {
+		return err
+	}
+
+	sw, err := wb.f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	err = sw.SetPanes(&excelize.Panes{
+		Freeze:      true,
+		YSplit:      1,
+		TopLeftCell: "A2",
+		ActivePane:  "bottomLeft",
+	})
+	if err != nil {
+		return err
+	}
+	if err := sw.SetRow("A1", wb.header); err != nil {
+		return err
+	}
+	wb.sw = sw
+	wb.row = 1
+	return nil
+}
+
+// write adds a row to the open sheet, continuing on a new sheet when it is full
+func (wb *xlsxWorkbook) write(values []interface{}) error {
+	if wb.row == excelize.TotalRows {
+		if err := wb.open(wb.name); err != nil {
+			return err
+		}
+	}
+	wb.row++
+	cell, err := excelize.CoordinatesToCellName(1, wb.row)
+	if err != nil {
+		return err
+	}
+	return wb.sw.SetRow(cell, values)
+}
+
+// flush ends the open sheet
+func (wb *xlsxWorkbook) flush() error {
+	if wb.sw == nil || len(wb.header) == 0 {
+		return nil
+	}
+	last, err := excelize.CoordinatesToCellName(len(wb.header), wb.row)
+	if err != nil {
+		return err
+	}
+	err = wb.sw.AddTable(&excelize.Table{
+		Range:     "A1:" + last,
+		Name:      fmt.Sprintf("table_%d", wb.sheets),
+		StyleName: "TableStyleLight1",
+	})
+	if err != nil {
+		return err
+	}
+	err = wb.sw.Flush()
+	wb.sw = nil
+	return err
+}
+
+// streamXLSX writes the rows as Excel workbook. With groupby every group is
+// written to its own sheet, named after its keys, which needs the query
+// built by ConstructGroupQuery. The sheets are buffered in temporary files by
+// the stream writers, the workbook is only written once all rows are read.
+func streamXLSX(w http.ResponseWriter, rows *sql.Rows, requestData *RequestData) error {
+	s, err := newRowScanner(rows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	keyIndexes, err := groupKeyIndexes(s.Columns, requestData.GroupBy)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil
+	}
+	levelIndexes, err := groupLevelIndexes(s.Columns, len(requestData.GroupBy))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+
+	wb, err := newXLSXWorkbook(s.VisibleColumns())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+	defer wb.f.Close()
+
+	cells := make([]interface{}, len(s.Visible))
+	keys := make([]string, len(keyIndexes))
+	group := int64(0)
+	for s.Next() {
+		if len(keyIndexes) > 0 {
+			// The innermost position changes with the keys of every level
+			if position := groupPosition(s.Values[levelIndexes[len(levelIndexes)-1]]); wb.sheets == 0 || position != group {
+				group = position
+				for i, index := range keyIndexes {
+					keys[i] = groupKey(s.Values[index])
+				}
+				if err := wb.open(strings.Join(keys, " - ")); err != nil {
+					http.Error(w, err.Error(), 400)
+					return nil
+				}
+			}
+		} else if wb.sheets == 0 {
+			if err := wb.open("data"); err != nil {
+				http.Error(w, err.Error(), 500)
+				return nil
+			}
+		}
+
+		for n, i := range s.Visible {
+			cells[n] = xlsxValue(s.Types[i].DatabaseTypeName(), s.Values[i], wb.styles)
+		}
+		if err := wb.write(cells); err != nil {
+			http.Error(w, err.Error(), 500)
+			return nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+
+	if wb.sheets == 0 {
+		if err := wb.open("data"); err != nil {
+			http.Error(w, err.Error(), 500)
+			return nil
+		}
+	}
+	if err := wb.flush(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil
+	}
+
+	w.Header().Set("Content-Disposition", attachment(requestData, "xlsx"))
+	w.WriteHeader(http.StatusOK)
+	return wb.f.Write(w)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestSheetName(t *testing.T) {
+	used := map[string]bool{}
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{"eth0", "eth0"},
+		{"ETH0", "ETH0 (2)"},
+		{"10.0.0.0/8", "10.0.0.0_8"},
+		{"'quoted'", "quoted"},
+		{"", "(empty)"},
+		{"a very long group name of more than 31 characters", "a very long group name of more "},
+		{"a very long group name of more than 31 characters", "a very long group name of m (2)"},
+	}
+
+	for i, tc := range testCases {
+		if name := sheetName(tc.name, used); name != tc.expected {
+			t.Errorf("test number %d: expected %q, got %q", i, tc.expected, name)
+		}
+	}
+}
+
+func TestStreamXLSX(t *testing.T) {
+	seen := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	result := fakeResult{
+		Columns: []string{"device", "mtu", "rate", "seen", "groups", groupRowColumn, groupLevelColumn + "1"},
+		Types:   []string{"TEXT", "INT4", "NUMERIC", "TIMESTAMPTZ", "_TEXT", "INT8", "INT8"},
+		Rows: [][]driver.Value{
+			{"eth0", int64(1500), []byte("0.25"), seen, []byte("{ops,admin}"), int64(1), int64(1)},
+			{"eth0", int64(9000), nil, seen, nil, int64(2), int64(1)},
+			{"eth1", int64(1500), []byte("1"), nil, []byte("{ops}"), int64(3), int64(2)},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	encodeResponse(w, queryFake(t, result), &RequestData{Format: "xlsx", GroupBy: []string{"device"}, Name: "domain.arp"})
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=domain.arp.xlsx" {
+		t.Errorf("unexpected disposition %s", disposition)
+	}
+
+	f, err := excelize.OpenReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if sheets := f.GetSheetList(); len(sheets) != 2 || sheets[0] != "eth0" || sheets[1] != "eth1" {
+		t.Fatalf("expected a sheet per device, got %v", sheets)
+	}
+
+	rows, err := f.GetRows("eth0", excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || len(rows[0]) != 5 || rows[0][4] != "groups" {
+		t.Fatalf("expected header and two rows without the row numbers, got %v", rows)
+	}
+	if rows[1][1] != "1500" || rows[1][2] != "0.25" || rows[1][4] != "ops, admin" {
+		t.Errorf("unexpected row %v", rows[1])
+	}
+
+	for _, cell := range []string{"B2", "C2", "D2"} {
+		if cellType, _ := f.GetCellType("eth0", cell); cellType != excelize.CellTypeUnset && cellType != excelize.CellTypeNumber {
+			t.Errorf("expected a number in %s, got type %v", cell, cellType)
+		}
+	}
+	if value, _ := f.GetCellValue("eth0", "D2"); value != "3/1/24 12:30" {
+		t.Errorf("expected a formatted timestamp, got %s", value)
+	}
+
+	panes, err := f.GetPanes("eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !panes.Freeze || panes.YSplit != 1 {
+		t.Errorf("expected a frozen header row, got %+v", panes)
+	}
+
+	tables, err := f.GetTables("eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Range != "A1:E2" {
+		t.Errorf("expected a table over the rows, got %+v", tables)
+	}
+}